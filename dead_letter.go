@@ -2,16 +2,38 @@ package deadletterqueue
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ClientParam represent redis queue inputs from user
@@ -20,35 +42,529 @@ type ClientParam struct {
 	RedisPasw string
 	QueueName string
 	Ctx       context.Context
-	DeadHTTP  []int
+	// DeadHTTP is the status codes moved to the dead letter queues, nil sets the
+	// default status codes and empty disables the dead lettering
+	DeadHTTP []int
+	// RetryableHTTP is the dead status codes retried from the dead queues if
+	// set, other dead messages are moved to the failed queue right away e.g
+	// 400 and 403 that won't succeed on retry. nil retries all the dead codes
+	RetryableHTTP []int
+	// RedisDB is the redis logical DB index, not supported by redis cluster
+	RedisDB int
+	// RedisTLS connects to redis over TLS if set, e.g for managed redis with
+	// encryption in transit
+	RedisTLS *tls.Config
+	// RedisOptions takes precedence over RedisAddr, RedisPasw, RedisDB and RedisTLS if set
+	// e.g for DB index, dial timeouts, TLS or options parsed by redis.ParseURL
+	RedisOptions *redis.Options
+	// ClusterAddrs connects to redis cluster with the seed node addresses if set
+	// RedisPasw is used as the cluster password
+	ClusterAddrs []string
+	// MasterName and SentinelAddrs connect to redis via sentinel failover if set
+	// RedisPasw is used as the master password
+	MasterName    string
+	SentinelAddrs []string
+	// RequestTimeout is the time limit for each HTTP request
+	RequestTimeout time.Duration
+	// HTTPClient is used for all the requests if set, e.g for custom TLS or proxy
+	// RequestTimeout is ignored in such case
+	HTTPClient *http.Client
+	// DefaultHeaders are added to each request, e.g the shared auth and
+	// version headers. Message Headers take precedence over them
+	DefaultHeaders http.Header
+	// CookieJar persists the cookies set by the executed messages for the later
+	// ones, e.g session cookie of a login request. It's set on HTTPClient as
+	// well if HTTPClient has no jar of it's own
+	CookieJar http.CookieJar
+	// FollowRedirects set to false returns the 3xx response as is in place of
+	// following the redirect, so the original status is dead lettered. nil
+	// follows the redirects
+	FollowRedirects *bool
+	// MaxRetries is the number of dead queue retries after which message is moved
+	// to the failed queue, zero means retry forever
+	MaxRetries int
+	// DeadToMainQueue pushes the failed messages back to the queue they
+	// originated from, in place of the status code dead queues. Retries are
+	// counted from the second failure as with the dead queues. MaxRetries
+	// still moves them to the failed queue
+	DeadToMainQueue bool
+	// BackoffBase is the delay before first dead queue retry, it doubles with every retry
+	// zero disables the backoff
+	BackoffBase time.Duration
+	// BackoffMax caps the backoff delay, zero means no cap
+	BackoffMax time.Duration
+	// DeadMessageMaxAge moves the dead message to the failed queue in place of
+	// retrying, once it's first failure is older than the age, zero means no expiry
+	DeadMessageMaxAge time.Duration
+	// MaxDeadQueueSize caps the length of each dead queue, messages past it
+	// are dropped as per OverflowPolicy, zero means no cap
+	MaxDeadQueueSize int
+	// OverflowPolicy decides the message dropped from the full dead queue,
+	// defaults to OverflowDropOldest
+	OverflowPolicy OverflowPolicy
+	// BackoffJitter picks a random delay between zero and the backoff delay, so
+	// the messages dead lettered together are not retried together
+	BackoffJitter bool
+	// Logger is used for all the client logs, defaults to the standard logger
+	Logger Logger
+	// RedactHeaders are the request headers whose values are masked as "***"
+	// in the logs, nil defaults to Authorization and Cookie
+	RedactHeaders []string
+	// Concurrency is the number of messages executed in parallel, messages are
+	// executed one by one in queue order by default. It applies within a single
+	// queue run, the queue lock keeps other consumers off the queue meanwhile
+	Concurrency int
+	// FailFast stops the queue execution at the first dead message as well, in
+	// place of only the request errors
+	FailFast bool
+	// LockTTL is the TTL of the lock held on the queue while it's executed, so
+	// only one consumer drains it at a time and no message is executed twice.
+	// Lock is refreshed while the queue is executed and expires post the TTL
+	// if the consumer dies, defaults to DefaultLockTTL
+	LockTTL time.Duration
+	// Metrics instruments the queue operations if set
+	Metrics Metrics
+	// TracerProvider wraps each message request in a span if set, the trace
+	// context is propagated in the request headers
+	TracerProvider trace.TracerProvider
+	// Propagator injects the trace context in the request headers, defaults to
+	// the global otel propagator
+	Propagator propagation.TextMapPropagator
+	// OnResult is called post each message execution with the response or the
+	// request error, response body is already read and stored by then
+	OnResult func(msg InputMsg, res *http.Response, err error)
+	// OnSuccess is called post removing the succeeded message from the queue,
+	// e.g to update the external state. res is nil for the message removed
+	// as already succeeded by CacheSuccesses
+	OnSuccess func(msg InputMsg, res *http.Response)
+	// OnPermanentFailure is called post moving the message that exhausted
+	// MaxRetries to the failed queue, e.g to notify ops
+	OnPermanentFailure func(msg InputMsg, attempts []Attempt)
+	// RequestMutator transforms the message just before building the request
+	// e.g to inject the current auth token, the stored message isn't changed
+	RequestMutator func(msg InputMsg) InputMsg
+	// SignRequest is called just before sending each request, e.g to set the
+	// HMAC signature computed over the method, path, body and timestamp. Body
+	// is read with req.GetBody if set. Message stays in the queue if it returns error
+	SignRequest func(req *http.Request) error
+	// IsDead decides if the response is dead in place of DeadHTTP status codes
+	// if set, e.g APIs returning 200 with an error body
+	IsDead func(res *http.Response, body []byte) bool
+	// DedupWindow refuses to add a duplicate of the message added within the
+	// window, zero disables deduplication
+	DedupWindow time.Duration
+	// MaxMessageBytes refuses to add the message whose stored size is past
+	// the limit, zero means no limit
+	MaxMessageBytes int
+	// ResponseTTL expires the stored message responses, zero keeps them forever
+	ResponseTTL time.Duration
+	// KeepFailedResponses stores the response of each failed attempt of the
+	// message under name:attempt key as well, retaining the latest count of
+	// them for debugging. Zero keeps only the latest response
+	KeepFailedResponses int
+	// DryRun logs the requests in place of sending them, messages are not
+	// removed from the queue
+	DryRun bool
+	// RateLimit paces the outbound requests to the requests per second across
+	// all the workers, zero disables the limit
+	RateLimit float64
+	// MaxResponseBytes truncates the response body read post the limit, zero
+	// reads the complete body
+	MaxResponseBytes int64
+	// CacheSuccesses skips the request of the message whose ID already has a
+	// stored 2xx response, the message is removed as executed
+	CacheSuccesses bool
+	// Codec serializes the stored messages and responses, defaults to JSONCodec
+	Codec Codec
+	// Compress gzips the stored messages and responses, uncompressed messages
+	// stored earlier are still read as is. Compressed entries are read
+	// irrespective of Compress
+	Compress bool
+	// KeyPrefix is prepended to all the redis keys i.e queues and stored
+	// responses, e.g "dlq:myapp:" to avoid collision with other data
+	KeyPrefix string
+	// ResponsePrefix namespaces the stored response keys after KeyPrefix, so
+	// message names don't collide with the queues or other keys, empty sets
+	// DefaultResponsePrefix
+	ResponsePrefix string
 }
 
 // Client represents interface for redis queue
 type Client struct {
-	redisCli  *redis.Client
-	queueName string
-	ctx       context.Context
-	deadHTTP  []int
+	redisCli    redis.UniversalClient
+	httpClient  *http.Client
+	queueName   string
+	ctx         context.Context
+	deadHTTP    []int
+	retryable   []int
+	maxRetries  int
+	deadToMain  bool
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	jitter      bool
+	deadMaxAge  time.Duration
+	maxDeadSize int
+	overflow    OverflowPolicy
+	logger      Logger
+	redact      []string
+	defHeaders  http.Header
+	concurrency int
+	failFast    bool
+	lockTTL     time.Duration
+	metrics     Metrics
+	tracer      trace.Tracer
+	propagator  propagation.TextMapPropagator
+	onResult    func(msg InputMsg, res *http.Response, err error)
+	onSuccess   func(msg InputMsg, res *http.Response)
+	isDead      func(res *http.Response, body []byte) bool
+	onFailure   func(msg InputMsg, attempts []Attempt)
+	mutator     func(msg InputMsg) InputMsg
+	signRequest func(req *http.Request) error
+	dedupWindow time.Duration
+	maxMsgBytes int
+	responseTTL time.Duration
+	keepFailed  int
+	dryRun      bool
+	limiter     *rateLimiter
+	maxResBytes int64
+	keyPrefix   string
+	respPrefix  string
+	cacheOK     bool
+	codec       Codec
+}
+
+// Logger represents the logging interface used by the client
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// Metrics represents the hooks to instrument queue operations, e.g with
+// prometheus counters and histograms
+type Metrics interface {
+	// MsgEnqueued is called for each message added to the qName queue
+	MsgEnqueued(qName string)
+	// MsgExecuted is called for each executed message with the response status
+	// code, zero for network failure, and the request latency
+	MsgExecuted(qName string, statusCode int, success bool, latency time.Duration)
+	// MsgDeadLettered is called for each message moved to deadQName queue
+	MsgDeadLettered(deadQName string, statusCode int)
+	// QueueDepth is called with the current qName queue length post each operation
+	QueueDepth(qName string, depth int64)
+}
+
+// DropMetrics is optionally implemented by Metrics to count the dead messages
+// dropped on MaxDeadQueueSize overflow
+type DropMetrics interface {
+	// MsgDropped is called with the number of messages dropped from or not
+	// added to deadQName queue
+	MsgDropped(deadQName string, count int)
+}
+
+// OverflowPolicy represents the message dropped from the full dead queue
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest trims the oldest dead messages to fit the new one
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowReject drops the new dead message
+	OverflowReject
+)
+
+// Codec represents the serialization of the stored messages and responses
+// e.g for a faster JSON library or compression
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec serializes with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// gzipCodec compresses the codec output if compress is set, compressed data is
+// marked with compressMagic header so both the compressed and uncompressed data
+// are read irrespective of compress
+type gzipCodec struct {
+	codec    Codec
+	compress bool
+}
+
+// compressMagic marks the compressed data, JSON never starts with a null byte
+const compressMagic = "\x00gz"
+
+func (g gzipCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := g.codec.Marshal(v)
+	if err != nil || !g.compress {
+		return data, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(compressMagic)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g gzipCodec) Unmarshal(data []byte, v interface{}) error {
+	data, err := decompress(data)
+	if err != nil {
+		return err
+	}
+	return g.codec.Unmarshal(data, v)
+}
+
+// decompress returns the compressed data uncompressed, data without the
+// compressMagic header is returned as is
+func decompress(data []byte) ([]byte, error) {
+	if !isCompressed(data) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data[len(compressMagic):]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// isCompressed checks if data has compressMagic header
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(compressMagic))
+}
+
+// stdLogger wraps the standard logger as Logger
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Errorf(format string, v ...interface{}) {
+	log.Printf("ERROR "+format, v...)
 }
 
 // InputMsg represents input message to be added to queue
 type InputMsg struct {
+	// ID uniquely identifies the message, it's generated by AddMessage if empty
+	ID        string
 	Name      string
 	Url       string
 	ReqMethod string
 	PostParam url.Values
-	Headers   http.Header
+	// QueryParam is merged to the query string of Url
+	QueryParam url.Values
+	Headers    http.Header
+	// BasicAuthUser and BasicAuthPass set the basic auth Authorization header
+	// if either is set, in place of the one in Headers
+	BasicAuthUser string
+	BasicAuthPass string
+	// Body is sent as raw request body in place of PostParam, e.g JSON payload
+	// content-type of the body is set with Headers. GET and HEAD requests are
+	// sent without body
+	Body []byte
+	// Multipart is sent as multipart/form-data body in place of Body and
+	// PostParam if set, e.g for file uploads. It's content-type with the
+	// boundary replaces the one in Headers
+	Multipart []MultipartPart
+	Retries   int
+	FailedAt  time.Time
+	// ExecuteAt delays the execution of message added by AddDelayedMessage
+	ExecuteAt time.Time
+	// Attempts is the trail of failed executions of the dead message
+	Attempts []Attempt
+	// OriginQueue is the queue the dead message was first executed from
+	OriginQueue string
+	// DeadHTTP overrides the client DeadHTTP status codes for the message if set
+	// dead status codes outside the client DeadHTTP are moved to the
+	// StatusCustomDead queue
+	DeadHTTP []int
+	// SkipResponseStore doesn't store the response of the message, e.g for
+	// HEAD health checks or fire and forget notifications
+	SkipResponseStore bool
+	// Timeout overrides the client RequestTimeout for the message request if set
+	Timeout time.Duration
+	// EnqueuedAt is the time the message is added, it's set on adding if empty
+	EnqueuedAt time.Time
+	// Priority executes the message added by AddMessage ahead of the plain
+	// messages if above zero and behind them if below zero. Messages of same
+	// priority are executed in the order they are added
+	Priority int
+}
+
+// MultipartPart represents a field or a file of the multipart/form-data body
+type MultipartPart struct {
+	FieldName string
+	// FileName sends the part as file upload if set
+	FileName string
+	// ContentType of the part, file defaults to application/octet-stream
+	ContentType string
+	Content     []byte
+}
+
+// Attempt represents a failed execution of the message
+type Attempt struct {
+	Timestamp  time.Time
+	StatusCode int
+	// Error is the request error for StatusNetworkError
+	Error string
+}
+
+// ResponseRecord represents the stored response of an executed message
+type ResponseRecord struct {
+	StatusCode int
+	Headers    http.Header
+	// Body is the text response body, it's empty for binary response
+	Body       string
+	ExecutedAt time.Time
+	// Truncated is set if the body is cut at MaxResponseBytes
+	Truncated bool
+	// RawBody is the binary response body i.e not valid UTF-8, stored as base64
+	RawBody     []byte
+	ContentType string
 }
 
+// QueueStats represents the snapshot of the queue lengths
+type QueueStats struct {
+	ReqQueue int64
+	// DeadQueues is keyed by the dead status code
+	DeadQueues map[int]int64
+	Failed     int64
+}
+
+// QueueSnapshot represents the messages of all the queues, see Export
+type QueueSnapshot struct {
+	ReqQueue []InputMsg
+	// DeadQueues is keyed by the dead status code
+	DeadQueues map[int][]InputMsg
+	Failed     []InputMsg
+	// Delayed and Priority messages are not yet moved to the request queue
+	Delayed  []InputMsg
+	Priority []InputMsg
+}
+
+// ExecResult represents the result of an executed message
+type ExecResult struct {
+	Name       string
+	StatusCode int
+	Success    bool
+	Err        error
+}
+
+// Errors returned by the client, wrapped with the detail, check with errors.Is
+var (
+	// ErrDuplicateMessage is returned by AddMessage for duplicate message within DedupWindow
+	ErrDuplicateMessage = errors.New("duplicate message within dedup window")
+	// ErrMsgNotFound is returned for the message or response not available
+	ErrMsgNotFound = errors.New("msg not found")
+	// ErrQueueEmpty is returned for the message looked up in an empty queue
+	// it matches ErrMsgNotFound as well
+	ErrQueueEmpty = fmt.Errorf("queue is empty, %w", ErrMsgNotFound)
+	// ErrRedisUnavailable is returned for the failed redis commands
+	ErrRedisUnavailable = errors.New("redis unavailable")
+	// ErrMarshal is returned for the message or response failed to marshal/unmarshal
+	ErrMarshal = errors.New("error marshalling msg")
+	// ErrMessageTooLarge is returned by AddMessage for the message past MaxMessageBytes
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrQueueLocked is returned for the queue being executed by another consumer
+	ErrQueueLocked = errors.New("queue is locked by another consumer")
+)
+
 // Constants
 const (
 	// Queue type
 	QueueReq  = "request"
 	QueueDead = "dead"
+
+	// Queue name for messages that exhausted all the retries
+	QueueFailed = "failed"
+	// Queue name for stored messages that failed to unmarshal
+	QueueCorrupt = "corrupt"
+	// Suffix of the request queue name for the delayed messages sorted set
+	DelayedSuffix = ":delayed"
+	// Suffix of the request queue name for the priority messages sorted set
+	PrioritySuffix = ":priority"
+	// Suffix of the request queue name for the dedup message hash keys
+	DedupSuffix = ":dedup:"
+	// Suffix of the queue name for the execution lock key
+	LockSuffix = ":lock"
+	// Prefix of the stored message response keys
+	DefaultResponsePrefix = "resp:"
+
+	// Dead status code for requests failed without a response, i.e connection
+	// refused, DNS failure or timeout
+	StatusNetworkError = 0
+
+	// Dead status code for responses marked dead by IsDead with a status
+	// code outside DeadHTTP, e.g 200 with an error body
+	StatusCustomDead = 1
+
+	// Response body stored for the messages executed in dry run
+	DryRunBody = "dry run"
+
+	// Logged in place of the redacted header values
+	RedactedValue = "***"
+
+	// Instrumentation name of the message request spans
+	TracerName = "github.com/ranjanrak/dead-letter-queue"
+
+	// Default HTTP request timeout
+	DefaultRequestTimeout = 30 * time.Second
+
+	// Default TTL of the queue execution lock
+	DefaultLockTTL = time.Minute
+
+	// Number of keys scanned per SCAN call
+	scanBatch = 100
 )
 
-// New creates new redis client
-func New(userParam ClientParam) *Client {
+// Number of queue messages fetched per LRANGE call while paging the queue
+var queuePageSize int64 = 100
+
+// unlockScript deletes the lock only if it's still held with the token
+const unlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`
+
+// refreshLockScript extends the lock TTL in ms only if it's still held with
+// the token
+const refreshLockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`
+
+// moveScript removes the first occurrence of ARGV[1] from the KEYS[1] list and
+// pushes ARGV[2] to the KEYS[2] list only if it's removed
+const moveScript = `local removed = redis.call("lrem", KEYS[1], 1, ARGV[1])
+if removed > 0 then
+	redis.call("rpush", KEYS[2], ARGV[2])
+end
+return removed`
+
+// Interval between the queue length polls of WaitForEmpty
+var emptyPollInterval = 100 * time.Millisecond
+
+// Timeout of the redis calls that must go through after the client context is
+// cancelled, e.g releasing the queue lock on shutdown
+var cleanupTimeout = 5 * time.Second
+
+// errLimitReached stops paging the queue once the execution limit is reached
+var errLimitReached = errors.New("execution limit reached")
+
+// New creates new redis client, it returns error if redis is not reachable
+func New(userParam ClientParam) (*Client, error) {
 	// Set default redis address
 	if userParam.RedisAddr == "" {
 		userParam.RedisAddr = "localhost:6379"
@@ -61,239 +577,2712 @@ func New(userParam ClientParam) *Client {
 	if userParam.Ctx == nil {
 		userParam.Ctx = context.TODO()
 	}
-	// Set default deadhttp status codes
-	// Dead letter queues will store input params for such HTTPs only to retry/debug later-on
-	if userParam.DeadHTTP == nil {
-		userParam.DeadHTTP = []int{400, 403, 429, 500, 502, 503, 504}
+	userParam.DeadHTTP = deadHTTPCodes(userParam.DeadHTTP)
+	// Set default HTTP request timeout
+	if userParam.RequestTimeout == 0 {
+		userParam.RequestTimeout = DefaultRequestTimeout
 	}
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     userParam.RedisAddr,
-		Password: userParam.RedisPasw,
-	})
-	return &Client{
-		redisCli:  rdb,
-		queueName: userParam.QueueName,
-		ctx:       userParam.Ctx,
-		deadHTTP:  userParam.DeadHTTP,
+	// Set default logger
+	if userParam.Logger == nil {
+		userParam.Logger = stdLogger{}
+	}
+	// Set default headers redacted in the logs
+	if userParam.RedactHeaders == nil {
+		userParam.RedactHeaders = []string{"Authorization", "Cookie"}
+	}
+	// Set default concurrency
+	if userParam.Concurrency < 1 {
+		userParam.Concurrency = 1
+	}
+	// Queue is always locked while it's executed, messages aren't claimed by
+	// the queue run
+	if userParam.LockTTL <= 0 {
+		userParam.LockTTL = DefaultLockTTL
+	}
+	// Set default codec
+	if userParam.Codec == nil {
+		userParam.Codec = JSONCodec{}
 	}
+	// Compressed entries are read even with the compression turned off, e.g
+	// once it's disabled post storing them
+	userParam.Codec = gzipCodec{codec: userParam.Codec, compress: userParam.Compress}
+	userParam.HTTPClient = newHTTPClient(userParam)
+	// Spans are created only with the tracer provider set
+	var tracer trace.Tracer
+	if userParam.TracerProvider != nil {
+		tracer = userParam.TracerProvider.Tracer(TracerName)
+	}
+	// Set default trace context propagator
+	if userParam.Propagator == nil {
+		userParam.Propagator = otel.GetTextMapPropagator()
+	}
+	if userParam.ResponsePrefix == "" {
+		userParam.ResponsePrefix = DefaultResponsePrefix
+	}
+	rdb := newRedisClient(userParam)
+	// Validate redis connectivity
+	err := rdb.Ping(userParam.Ctx).Err()
+	if err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("error connecting redis : %w", err)
+	}
+	return &Client{
+		redisCli:    rdb,
+		httpClient:  userParam.HTTPClient,
+		queueName:   userParam.QueueName,
+		ctx:         userParam.Ctx,
+		deadHTTP:    userParam.DeadHTTP,
+		retryable:   userParam.RetryableHTTP,
+		maxRetries:  userParam.MaxRetries,
+		deadToMain:  userParam.DeadToMainQueue,
+		backoffBase: userParam.BackoffBase,
+		backoffMax:  userParam.BackoffMax,
+		jitter:      userParam.BackoffJitter,
+		deadMaxAge:  userParam.DeadMessageMaxAge,
+		maxDeadSize: userParam.MaxDeadQueueSize,
+		overflow:    userParam.OverflowPolicy,
+		logger:      userParam.Logger,
+		redact:      userParam.RedactHeaders,
+		defHeaders:  userParam.DefaultHeaders.Clone(),
+		concurrency: userParam.Concurrency,
+		failFast:    userParam.FailFast,
+		lockTTL:     userParam.LockTTL,
+		metrics:     userParam.Metrics,
+		tracer:      tracer,
+		propagator:  userParam.Propagator,
+		onResult:    userParam.OnResult,
+		onSuccess:   userParam.OnSuccess,
+		isDead:      userParam.IsDead,
+		onFailure:   userParam.OnPermanentFailure,
+		mutator:     userParam.RequestMutator,
+		signRequest: userParam.SignRequest,
+		dedupWindow: userParam.DedupWindow,
+		maxMsgBytes: userParam.MaxMessageBytes,
+		responseTTL: userParam.ResponseTTL,
+		keepFailed:  userParam.KeepFailedResponses,
+		dryRun:      userParam.DryRun,
+		limiter:     newRateLimiter(userParam.RateLimit),
+		maxResBytes: userParam.MaxResponseBytes,
+		keyPrefix:   userParam.KeyPrefix,
+		respPrefix:  userParam.ResponsePrefix,
+		cacheOK:     userParam.CacheSuccesses,
+		codec:       userParam.Codec,
+	}, nil
 }
 
-// AddMessage adds incoming new HTTP request message to redis queue
-func (c *Client) AddMessage(message InputMsg) error {
-	return c.SetQueue(c.queueName, message)
+// Ping checks the redis connection is alive, e.g for readiness probes
+func (c *Client) Ping() error {
+	err := c.redisCli.Ping(c.ctx).Err()
+	if err != nil {
+		return redisErr(err)
+	}
+	return nil
 }
 
-// ExecuteQueue executes all available messages in the request queue
-func (c *Client) ExecuteQueue() {
-	c.ExecuteQueueName(c.queueName)
+// Close closes the redis connection, Client should not be used post Close
+func (c *Client) Close() error {
+	return c.redisCli.Close()
 }
 
-// ExecuteDeadQueue executes all available messages in the dead queues
-func (c *Client) ExecuteDeadQueue() {
-	for _, deadQue := range c.deadHTTP {
-		c.ExecuteQueueName(strconv.Itoa(deadQue))
+// WithContext returns a copy of the client using ctx in place of the client
+// context for the redis and HTTP calls, e.g for the deadline of an HTTP
+// handler. The copy shares the connections with the client, nil ctx keeps
+// the client context
+func (c *Client) WithContext(ctx context.Context) *Client {
+	cc := *c
+	if ctx != nil {
+		cc.ctx = ctx
 	}
+	return &cc
 }
 
-// ExecuteQueueName is wrapper for RawExecute on qName queue
-func (c *Client) ExecuteQueueName(qName string) {
-	// fetch all messages available in the queue
-	msgQueue := c.GetQueue(qName)
-	if len(msgQueue) > 0 {
-		for _, queue := range msgQueue {
-			c.RawExecute(queue, qName)
-		}
-	} else {
-		log.Printf("No messages in %v queue to execute", qName)
-	}
+// rateLimiter is a token bucket of single token refilled every interval
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
 }
 
-// RawExecute performs the HTTP request based on request params
-func (c *Client) RawExecute(msg InputMsg, qName string) {
-	var postBody io.Reader
-	if msg.ReqMethod == "POST" || msg.ReqMethod == "PUT" {
-		// convert post params map into “URL encoded”
-		if msg.PostParam != nil {
-			paramsEncoded := msg.PostParam.Encode()
-			postBody = bytes.NewReader([]byte(paramsEncoded))
-		}
+// newRateLimiter creates limiter for rps requests per second, nil for no limit
+func newRateLimiter(rps float64) *rateLimiter {
+	if rps <= 0 {
+		return nil
 	}
-	req, _ := http.NewRequest(msg.ReqMethod, msg.Url, postBody)
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
 
-	// Add all request headers to the http request
-	if msg.Headers != nil {
-		req.Header = msg.Headers
+// wait blocks till the next token is available or ctx is cancelled
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
 	}
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Fatalf("Error making HTTP request : %v", err)
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
 	}
-	defer res.Body.Close()
+	delay := l.next.Sub(now)
+	// Reserve the token, so concurrent callers queue up one interval apart
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.Printf("Error reading response body %v", err)
+// deadHTTPCodes returns the dead status codes for the user DeadHTTP, nil sets
+// the default status codes and empty disables the dead lettering
+func deadHTTPCodes(deadHTTP []int) []int {
+	// Set default deadhttp status codes
+	// StatusNetworkError code stores requests failed without any response
+	// Dead letter queues will store input params for such HTTPs only to retry/debug later-on
+	if deadHTTP == nil {
+		deadHTTP = []int{StatusNetworkError, 400, 403, 429, 500, 502, 503, 504}
 	}
-	// Store response body data
-	c.MessageResponse(msg.Name, string(body))
+	if len(deadHTTP) == 0 {
+		return []int{}
+	}
+	// Dead queue for IsDead responses and message DeadHTTP status codes outside DeadHTTP
+	// Copied so the caller's slice backing array isn't written by the append
+	codes := make([]int, len(deadHTTP), len(deadHTTP)+1)
+	copy(codes, deadHTTP)
+	if !Find(codes, StatusCustomDead) {
+		codes = append(codes, StatusCustomDead)
+	}
+	return codes
+}
 
-	c.HandleDeadQueue(res, msg, qName)
+// newHTTPClient returns the HTTP client for the requests, user HTTPClient is
+// copied if the cookie jar or the redirect policy is set, so it isn't changed
+func newHTTPClient(userParam ClientParam) *http.Client {
+	// Set default HTTP client
+	if userParam.HTTPClient == nil {
+		return &http.Client{
+			Timeout:       userParam.RequestTimeout,
+			Jar:           userParam.CookieJar,
+			CheckRedirect: checkRedirect(userParam.FollowRedirects),
+		}
+	}
+	setJar := userParam.CookieJar != nil && userParam.HTTPClient.Jar == nil
+	noRedirect := checkRedirect(userParam.FollowRedirects) != nil
+	if !setJar && !noRedirect {
+		return userParam.HTTPClient
+	}
+	httpClient := *userParam.HTTPClient
+	if setJar {
+		httpClient.Jar = userParam.CookieJar
+	}
+	if noRedirect {
+		httpClient.CheckRedirect = checkRedirect(userParam.FollowRedirects)
+	}
+	return &httpClient
 }
 
-// MessageResponse stores response body of the request body
-func (c *Client) MessageResponse(msgName string, response string) {
-	err := c.redisCli.Set(c.ctx, msgName, response, 0).Err()
-	if err != nil {
-		log.Printf("Error updating response for the req message %s", msgName)
+// checkRedirect returns the redirect policy, nil for the default policy of
+// following up to 10 redirects
+func checkRedirect(followRedirects *bool) func(req *http.Request, via []*http.Request) error {
+	if followRedirects == nil || *followRedirects {
+		return nil
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
 	}
 }
 
-// HandleDeadQueue creates/update dead queue to retry later
-func (c *Client) HandleDeadQueue(res *http.Response, msg InputMsg, qName string) {
-	// Create/add dead letter queue based on user input for deadHTTP
-	if Find(c.deadHTTP, res.StatusCode) {
-		// Alert user with failed status for HTTP request
-		log.Printf("Request msg %s, failed with status %s", msg.Name, res.Status)
-		// Add failed messages to dead letter queue
-		qkey := strconv.Itoa(res.StatusCode)
-		err := c.SetQueue(qkey, msg)
-		if err != nil {
-			log.Fatalf("Error adding dead queue : %v", err)
-		}
+// newRedisClient creates cluster, sentinel failover or single node redis client
+// based on user params
+func newRedisClient(userParam ClientParam) redis.UniversalClient {
+	if userParam.MasterName != "" && len(userParam.SentinelAddrs) > 0 {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    userParam.MasterName,
+			SentinelAddrs: userParam.SentinelAddrs,
+			Password:      userParam.RedisPasw,
+			DB:            userParam.RedisDB,
+			TLSConfig:     userParam.RedisTLS,
+		})
 	}
-	// Delete executed message from the redis list
-	err := c.redisCli.LTrim(c.ctx, qName, 1, -1).Err()
-	if err != nil {
-		log.Fatalf("Error removing the queue member: %v", err)
+	if len(userParam.ClusterAddrs) > 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     userParam.ClusterAddrs,
+			Password:  userParam.RedisPasw,
+			TLSConfig: userParam.RedisTLS,
+		})
+	}
+	// Set default redis options
+	if userParam.RedisOptions == nil {
+		userParam.RedisOptions = &redis.Options{
+			Addr:      userParam.RedisAddr,
+			Password:  userParam.RedisPasw,
+			DB:        userParam.RedisDB,
+			TLSConfig: userParam.RedisTLS,
+		}
 	}
+	return redis.NewClient(userParam.RedisOptions)
 }
 
-// Fetch message response status
-func (c *Client) MessageStatus(msgName string) (string, error) {
-	val, err := c.redisCli.Get(c.ctx, msgName).Result()
-	return val, err
+// AddMessage adds incoming new HTTP request message to redis queue
+func (c *Client) AddMessage(message InputMsg) error {
+	return c.AddMessageTo(c.queueName, message)
 }
 
-// Delete message by message name from request queue
-func (c *Client) DeleteReqMsg(msgName string) error {
-	return c.DelMsg(c.queueName, msgName)
+// AddMessageTo adds incoming new HTTP request message to the qName request
+// queue, e.g for multiple logical queues sharing the client. Dead messages of
+// the queue are moved to it's own dead queues named by DeadQueueName
+func (c *Client) AddMessageTo(qName string, message InputMsg) error {
+	if message.ID == "" {
+		message.ID = NewMsgID()
+	}
+	if message.EnqueuedAt.IsZero() {
+		message.EnqueuedAt = time.Now()
+	}
+	if err := c.checkSize(message); err != nil {
+		return err
+	}
+	dedupKey := qName + DedupSuffix + msgHash(message)
+	if c.dedupWindow > 0 {
+		// Record message hash, it's already set for duplicate within the window
+		added, err := c.redisCli.SetNX(c.ctx, c.key(dedupKey), 1, c.dedupWindow).Result()
+		if err != nil {
+			return redisErr(err)
+		}
+		if !added {
+			return fmt.Errorf("%w : %s", ErrDuplicateMessage, message.Name)
+		}
+	}
+	var err error
+	if message.Priority != 0 {
+		err = c.addPriority(qName, []InputMsg{message})
+	} else {
+		err = c.SetQueue(qName, message)
+	}
+	if err != nil {
+		// Message is not added, allow adding it again
+		if c.dedupWindow > 0 {
+			c.redisCli.Del(c.ctx, c.key(dedupKey))
+		}
+		return err
+	}
+	if c.metrics != nil {
+		c.metrics.MsgEnqueued(qName)
+		c.updateDepth(qName)
+	}
+	return nil
 }
 
-// Delete message by name from Deadletter queue
-func (c *Client) DeleteDeadMsg(msgName string) error {
-	// Search and delete msg name from all declared dead http queue
-	for _, value := range c.deadHTTP {
-		err := c.DelMsg(strconv.Itoa(value), msgName)
+// AddMessages adds batch of HTTP request messages to redis queue in single round-trip
+// messages are not checked for duplicates within DedupWindow
+func (c *Client) AddMessages(messages []InputMsg) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	var priorityMsgs []InputMsg
+	msgInputs := make([]interface{}, 0, len(messages))
+	for i, message := range messages {
+		if message.ID == "" {
+			message.ID = NewMsgID()
+		}
+		if message.EnqueuedAt.IsZero() {
+			message.EnqueuedAt = time.Now()
+		}
+		if err := c.checkSize(message); err != nil {
+			return fmt.Errorf("msg at index %d : %w", i, err)
+		}
+		if message.Priority != 0 {
+			priorityMsgs = append(priorityMsgs, message)
+			continue
+		}
+		msgInput, err := marshalMsg(c.codec, message)
+		if err != nil {
+			return fmt.Errorf("error marshalling msg at index %d : %w", i, err)
+		}
+		msgInputs = append(msgInputs, msgInput)
+	}
+	if len(msgInputs) > 0 {
+		err := c.redisCli.RPush(c.ctx, c.key(c.queueName), msgInputs...).Err()
+		if err != nil {
+			return redisErr(err)
+		}
+	}
+	if len(priorityMsgs) > 0 {
+		err := c.addPriority(c.queueName, priorityMsgs)
 		if err != nil {
 			return err
 		}
 	}
+	if c.metrics != nil {
+		for range messages {
+			c.metrics.MsgEnqueued(c.queueName)
+		}
+		c.updateDepth(c.queueName)
+	}
 	return nil
 }
 
-// Remove message from the requested queue
-func (c *Client) DelMsg(queName string, msgName string) error {
-	// Fetch message detail with message name
-	msg, err := Marshalmsg(c.MsgDetail(queName, msgName))
-	if err != nil {
-		return err
+// checkSize returns ErrMessageTooLarge if the marshalled message is past
+// maxMsgBytes
+func (c *Client) checkSize(message InputMsg) error {
+	if c.maxMsgBytes <= 0 {
+		return nil
 	}
-	err = c.redisCli.LRem(c.ctx, queName, 0, msg).Err()
+	msgInput, err := marshalMsg(c.codec, message)
 	if err != nil {
 		return err
 	}
+	if len(msgInput) > c.maxMsgBytes {
+		return fmt.Errorf("%w : %s is %d bytes, limit %d", ErrMessageTooLarge, message.Name, len(msgInput), c.maxMsgBytes)
+	}
 	return nil
 }
 
-// Clear complete request queue
-func (c *Client) ClearReqQueue() error {
-	return c.ClearQueue(c.queueName)
-}
-
-// Cleat complete dead letter queue
-func (c *Client) ClearDeadQueue() error {
-	for _, value := range c.deadHTTP {
-		err := c.ClearQueue(strconv.Itoa(value))
+// addPriority adds the priority messages of qName queue to the sorted set
+// scored by the time they are added in microseconds, messages are offset by
+// their index so the batch keeps it's order
+func (c *Client) addPriority(qName string, messages []InputMsg) error {
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	members := make([]*redis.Z, 0, len(messages))
+	for i, message := range messages {
+		msgInput, err := marshalMsg(c.codec, message)
 		if err != nil {
 			return err
 		}
+		members = append(members, &redis.Z{Score: float64(now + int64(i)), Member: msgInput})
 	}
-	return nil
+	return redisErr(c.redisCli.ZAdd(c.ctx, c.key(priorityQueue(qName)), members...).Err())
 }
 
-// Clear complete queue of the given key/queue name
-func (c *Client) ClearQueue(qName string) error {
-	err := c.redisCli.Del(c.ctx, qName).Err()
+// AddDelayedMessage adds HTTP request message to be executed post message ExecuteAt
+// Delayed messages are stored in a sorted set scored by ExecuteAt
+func (c *Client) AddDelayedMessage(message InputMsg) error {
+	if message.ID == "" {
+		message.ID = NewMsgID()
+	}
+	if message.EnqueuedAt.IsZero() {
+		message.EnqueuedAt = time.Now()
+	}
+	if err := c.checkSize(message); err != nil {
+		return err
+	}
+	msgInput, err := marshalMsg(c.codec, message)
 	if err != nil {
 		return err
 	}
-	return nil
+	return redisErr(c.redisCli.ZAdd(c.ctx, c.key(c.delayedQueue()), &redis.Z{
+		Score:  float64(message.ExecuteAt.UnixNano() / int64(time.Millisecond)),
+		Member: msgInput,
+	}).Err())
 }
 
-// GetQueue fetches all messages in queue
-func (c *Client) GetQueue(qname string) []InputMsg {
-	// Fetch redis list
-	queSlice, err := c.redisCli.LRange(c.ctx, qname, 0, -1).Result()
+// ExecuteQueue executes all available messages in the request queue and returns
+// the number of executed messages
+// Delayed messages due for execution and priority messages are moved to the
+// request queue first
+func (c *Client) ExecuteQueue() (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("stopped executing %s queue : %w", c.queueName, err)
+	}
+	err := c.promoteDelayed()
 	if err != nil {
-		log.Fatalf("Error fetching queue : %v", err)
+		return 0, err
 	}
-	// Unmarshal each redis queue message to input message struct
-	var queueStruct []InputMsg
-	for _, queue := range queSlice {
-		queueStruct = append(queueStruct, Unmarshalmsg(queue))
+	return c.ExecuteQueueOf(c.queueName)
+}
+
+// ExecuteQueueOf executes all available messages in the qName request queue,
+// e.g added by AddMessageTo, and returns the number of executed messages
+// Priority messages of the queue are moved to it first
+func (c *Client) ExecuteQueueOf(qName string) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("stopped executing %s queue : %w", qName, err)
 	}
-	return queueStruct
+	err := c.promotePriority(qName)
+	if err != nil {
+		return 0, err
+	}
+	return c.ExecuteQueueName(qName)
 }
 
-// SetQueue marshals the input message struct and save it to redis
-func (c *Client) SetQueue(queName string, msg InputMsg) error {
-	msgInput, err := Marshalmsg(msg)
+// ExecuteBlocking waits up to timeout for a message in the request queue and
+// executes it, e.g for a low latency worker in place of polling ExecuteQueue.
+// It returns ErrQueueEmpty if no message arrives within the timeout, else the
+// error of the executed message. Delayed messages due for execution and
+// priority messages are moved to the request queue first. The message is taken
+// off the queue while it's executed and pushed back to the head if it's kept,
+// it's lost if the process exits meanwhile
+func (c *Client) ExecuteBlocking(timeout time.Duration) error {
+	if err := c.ctx.Err(); err != nil {
+		return fmt.Errorf("stopped executing %s queue : %w", c.queueName, err)
+	}
+	err := c.promoteDelayed()
 	if err != nil {
 		return err
 	}
-	// Set message to given queue name(key)
-	err = c.redisCli.RPush(c.ctx, queName, msgInput).Err()
+	err = c.promotePriority(c.queueName)
 	if err != nil {
 		return err
 	}
-	return nil
+	unlock, err := c.lockQueue(c.queueName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	popped, err := c.redisCli.BLPop(c.ctx, timeout, c.key(c.queueName)).Result()
+	if err == redis.Nil {
+		return fmt.Errorf("%w : no message within %v", ErrQueueEmpty, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching %s queue : %w", c.queueName, redisErr(err))
+	}
+	rawMsg := popped[1]
+	msg, err := unmarshalMsg(c.codec, rawMsg)
+	if err != nil {
+		// Message is already removed, keep it for inspection
+		c.logger.Errorf("Moving malformed msg of %s queue to %s queue : %v", c.queueName, QueueCorrupt, err)
+		if err := c.redisCli.RPush(c.ctx, c.key(QueueCorrupt), rawMsg).Err(); err != nil {
+			c.logger.Errorf("Error moving malformed msg to %s queue : %v", QueueCorrupt, err)
+		}
+		return nil
+	}
+	// Popped message is only in hand, it's pushed back to the head if it's
+	// not executed or dead lettered. It's pushed back on the client context
+	// cancellation too, so it isn't lost on shutdown
+	result, removed := c.executeMsg(msg, storedMsg{raw: rawMsg, popped: true}, c.queueName)
+	if !removed {
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		err := c.redisCli.LPush(ctx, c.key(c.queueName), rawMsg).Err()
+		if err != nil {
+			c.logger.Errorf("Error adding back msg %s to %s queue : %v", msg.Name, c.queueName, err)
+			if result.Err == nil {
+				result.Err = fmt.Errorf("error adding back msg %s to %s queue : %w", msg.Name, c.queueName, redisErr(err))
+			}
+		}
+	}
+	return result.Err
 }
 
-// Fetch input msg detail
-func (c *Client) MsgDetail(qName string, msgName string) InputMsg {
-	// fetch all messages available in queue
-	msgQueue := c.GetQueue(qName)
-	for _, msg := range msgQueue {
-		if msg.Name == msgName {
-			return msg
+// promotePriority moves the priority messages to the qName request queue,
+// messages above zero priority are pushed to the head and below zero to the
+// tail, in the order of priority then the time they are added
+func (c *Client) promotePriority(qName string) error {
+	members, err := c.redisCli.ZRange(c.ctx, c.key(priorityQueue(qName)), 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("error fetching priority messages : %w", redisErr(err))
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	var msgs []InputMsg
+	for _, member := range members {
+		msg, err := unmarshalMsg(c.codec, member)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+	// Members are in the order they are added, stable sort keeps it within
+	// the same priority
+	order := make([]int, len(msgs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return msgs[order[i]].Priority > msgs[order[j]].Priority
+	})
+	// Head is pushed from the lowest priority, so the highest ends up first
+	for i := len(order) - 1; i >= 0; i-- {
+		if msgs[order[i]].Priority > 0 {
+			err := c.promoteMember(qName, members[order[i]], true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, idx := range order {
+		if msgs[idx].Priority < 0 {
+			err := c.promoteMember(qName, members[idx], false)
+			if err != nil {
+				return err
+			}
 		}
 	}
-	return InputMsg{}
+	return nil
 }
 
-// Find takes a slice and looks for an element in it. If found it will
-// return bool true else false
-func Find(httpSlice []int, http int) bool {
-	for _, item := range httpSlice {
-		if item == http {
-			return true
+// promoteMember moves the raw priority message to the head or the tail of
+// the qName request queue
+func (c *Client) promoteMember(qName string, member string, head bool) error {
+	// Only the consumer that removed the message from the set promotes it
+	removed, err := c.redisCli.ZRem(c.ctx, c.key(priorityQueue(qName)), member).Result()
+	if err != nil {
+		return redisErr(err)
+	}
+	if removed == 0 {
+		return nil
+	}
+	if head {
+		return redisErr(c.redisCli.LPush(c.ctx, c.key(qName), member).Err())
+	}
+	return redisErr(c.redisCli.RPush(c.ctx, c.key(qName), member).Err())
+}
+
+// promoteDelayed moves the delayed messages due for execution to the request queue
+func (c *Client) promoteDelayed() error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	dueMsgs, err := c.redisCli.ZRangeByScore(c.ctx, c.key(c.delayedQueue()), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("error fetching delayed messages : %w", redisErr(err))
+	}
+	for _, msg := range dueMsgs {
+		// Only the consumer that removed the message from the set promotes it
+		removed, err := c.redisCli.ZRem(c.ctx, c.key(c.delayedQueue()), msg).Result()
+		if err != nil {
+			return redisErr(err)
+		}
+		if removed == 0 {
+			continue
+		}
+		err = c.redisCli.RPush(c.ctx, c.key(c.queueName), msg).Err()
+		if err != nil {
+			return redisErr(err)
 		}
 	}
-	return false
+	return nil
 }
 
-// Marshalmsg
-func Marshalmsg(msg InputMsg) ([]byte, error) {
-	return json.Marshal(msg)
+// key returns the redis key of the queue or response name with the key prefix
+func (c *Client) key(name string) string {
+	return c.keyPrefix + name
+}
+
+// responseKey returns the redis key of the msgName stored response
+func (c *Client) responseKey(msgName string) string {
+	return c.key(c.respPrefix + msgName)
+}
+
+// DeadQueueName returns the dead letter queue of the statusCode for the qName
+// request queue. Dead queues of the client QueueName are named by the status
+// code alone e.g "429", of other queues prefixed by the queue e.g "orders:429"
+func (c *Client) DeadQueueName(qName string, statusCode int) string {
+	if qName == "" || qName == c.queueName {
+		return strconv.Itoa(statusCode)
+	}
+	return qName + ":" + strconv.Itoa(statusCode)
+}
+
+// delayedQueue returns the sorted set name of the delayed messages
+func (c *Client) delayedQueue() string {
+	return c.queueName + DelayedSuffix
+}
+
+// priorityQueue returns the sorted set name of the qName priority messages
+func priorityQueue(qName string) string {
+	return qName + PrioritySuffix
+}
+
+// ExecuteDeadQueue executes all available messages in the dead queues and returns
+// the number of executed messages
+func (c *Client) ExecuteDeadQueue() (int, error) {
+	return c.ExecuteDeadQueueOf(c.queueName)
+}
+
+// ExecuteDeadQueueByCode executes all available messages in the dead queue of
+// the status code alone and returns the number of executed messages, e.g to
+// retry the 503s post an outage. It returns error if code isn't one of the
+// dead status codes
+func (c *Client) ExecuteDeadQueueByCode(code int) (int, error) {
+	return c.ExecuteDeadQueueByCodeOf(c.queueName, code)
+}
+
+// ExecuteDeadQueueByCodeOf is ExecuteDeadQueueByCode for the dead queue of the
+// qName request queue
+func (c *Client) ExecuteDeadQueueByCodeOf(qName string, code int) (int, error) {
+	if !Find(c.deadHTTP, code) {
+		return 0, fmt.Errorf("%d is not a dead status code", code)
+	}
+	return c.ExecuteQueueName(c.DeadQueueName(qName, code))
+}
+
+// ExecuteDeadQueueOf executes all available messages in the dead queues of the
+// qName request queue and returns the number of executed messages
+func (c *Client) ExecuteDeadQueueOf(qName string) (int, error) {
+	var processed int
+	for _, deadQue := range c.deadHTTP {
+		queProcessed, err := c.ExecuteQueueName(c.DeadQueueName(qName, deadQue))
+		processed += queProcessed
+		if err != nil {
+			return processed, err
+		}
+	}
+	return processed, nil
+}
+
+// StartRetryLoop executes the dead queues every interval in background till the
+// returned stop is called or the client context is cancelled
+// Runs never overlap, ticks missed by a run longer than interval are dropped.
+// Loop isn't started for interval of zero or below, stop is a no-op then
+func (c *Client) StartRetryLoop(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		c.logger.Errorf("Retry loop not started, interval %v must be above zero", interval)
+		return func() {}
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+				processed, err := c.ExecuteDeadQueue()
+				if err != nil {
+					c.logger.Errorf("Error executing the dead queues : %v", err)
+				}
+				if processed > 0 {
+					c.logger.Printf("Retried %d dead messages", processed)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		// Wait for the in-flight run to finish
+		<-exited
+	}
+}
+
+// ExecuteQueueName is wrapper for RawExecute on qName queue, it returns the
+// number of executed messages
+// It stops at the first failed request left in the queue or on client context
+// cancellation and returns it's error, the pending message is left at the head
+// of the queue to be executed on next run. Failed request moved to the dead
+// queue stops it only if failFast is set
+func (c *Client) ExecuteQueueName(qName string) (int, error) {
+	results, err := c.runQueue(qName, true, 0)
+	return len(results), err
+}
+
+// ExecuteQueueWithLimit executes up to max messages of the qName queue and
+// returns the number of executed messages, e.g for cron runs with a time
+// budget. Rest of the messages are left in the queue for the next run, max
+// of zero executes all. Delayed and priority messages of the request queue
+// are moved to it first
+func (c *Client) ExecuteQueueWithLimit(qName string, max int) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("stopped executing %s queue : %w", qName, err)
+	}
+	if !c.isDeadQueue(qName) {
+		if qName == c.queueName {
+			err := c.promoteDelayed()
+			if err != nil {
+				return 0, err
+			}
+		}
+		err := c.promotePriority(qName)
+		if err != nil {
+			return 0, err
+		}
+	}
+	results, err := c.runQueue(qName, true, max)
+	return len(results), err
+}
+
+// DrainDeadQueue executes all available messages in the dead queues and returns
+// the result of each executed message, failed requests don't stop the execution
+func (c *Client) DrainDeadQueue() ([]ExecResult, error) {
+	return c.DrainDeadQueueOf(c.queueName)
+}
+
+// DrainDeadQueueOf is DrainDeadQueue for the dead queues of the qName request
+// queue
+func (c *Client) DrainDeadQueueOf(qName string) ([]ExecResult, error) {
+	var results []ExecResult
+	for _, deadQue := range c.deadHTTP {
+		queResults, err := c.runQueue(c.DeadQueueName(qName, deadQue), false, 0)
+		results = append(results, queResults...)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// runQueue executes all available messages in qName queue and returns the
+// result of each executed message, stopOnErr stops at the first failed request
+// kept in the queue and limit stops post executing as many messages if above zero
+// Messages are executed in queue order unless concurrency is more than one.
+// Messages are read without claiming them, the queue lock keeps another
+// consumer from executing them meanwhile
+func (c *Client) runQueue(qName string, stopOnErr bool, limit int) ([]ExecResult, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, fmt.Errorf("stopped executing %s queue : %w", qName, err)
+	}
+	unlock, err := c.lockQueue(qName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var (
+		results []ExecResult
+		runErr  error
+		started int
+		mu      sync.Mutex
+	)
+	// setErr keeps the first error that stops the execution
+	setErr := func(err error) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if runErr == nil {
+			runErr = err
+		}
+		return runErr != nil
+	}
+	// Messages are executed page by page, each page is done before the next
+	// one is fetched past the messages left in the queue
+	visited, err := c.pageQueue(qName, func(msgQueue []InputMsg, raws []string) (int, error) {
+		var (
+			kept    int
+			limited bool
+			wg      sync.WaitGroup
+		)
+		// Semaphore bounds the number of in-flight requests
+		sem := make(chan struct{}, c.concurrency)
+		for i, queue := range msgQueue {
+			rawMsg := raws[i]
+			// Stop between messages once the client context is cancelled
+			if err := c.ctx.Err(); err != nil {
+				setErr(fmt.Errorf("stopped executing %s queue : %w", qName, err))
+				break
+			}
+			// Move dead messages older than the max age to the failed queue
+			if c.isDeadMsg(qName, queue) && c.deadExpired(queue) {
+				err := c.expireDeadMsg(qName, queue, rawMsg)
+				if err != nil {
+					setErr(err)
+					break
+				}
+				continue
+			}
+			// Skip dead messages still in backoff, they're left in place and
+			// the next page is fetched past them
+			if c.isDeadMsg(qName, queue) && !c.retryEligible(queue) {
+				c.logger.Printf("Request msg %s, in backoff till %v", queue.Name, queue.FailedAt.Add(c.retryDelay(queue)))
+				mu.Lock()
+				kept++
+				mu.Unlock()
+				continue
+			}
+			if limit > 0 && started == limit {
+				limited = true
+				break
+			}
+			started++
+			sem <- struct{}{}
+			// Stop on the error of previous executed message
+			if setErr(nil) {
+				<-sem
+				break
+			}
+			wg.Add(1)
+			go func(msg InputMsg, rawMsg string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				// Executed message is removed by value, so the workers of this
+				// run never remove each other's messages
+				result, removed := c.executeMsg(msg, storedMsg{raw: rawMsg}, qName)
+				mu.Lock()
+				results = append(results, result)
+				if !removed {
+					kept++
+				}
+				mu.Unlock()
+				// Failed request moved to the dead queue doesn't stop the run
+				// unless failFast is set, same as a failed status
+				if result.Err != nil && stopOnErr && (!removed || c.failFast) {
+					setErr(result.Err)
+				} else if !result.Success && stopOnErr && c.failFast {
+					setErr(fmt.Errorf("stopped executing %s queue, msg %s failed with status %d", qName, msg.Name, result.StatusCode))
+				}
+			}(queue, rawMsg)
+		}
+		wg.Wait()
+		if runErr == nil && limited {
+			return kept, errLimitReached
+		}
+		return kept, runErr
+	})
+	if err != nil && !errors.Is(err, errLimitReached) {
+		return results, err
+	}
+	if visited == 0 {
+		c.logger.Printf("No messages in %v queue to execute", qName)
+	}
+	return results, nil
+}
+
+// lockQueue acquires the qName queue lock and returns it's release, the lock is
+// refreshed till it's released. It returns ErrQueueLocked if another consumer
+// holds the lock
+func (c *Client) lockQueue(qName string) (func(), error) {
+	if c.lockTTL == 0 {
+		return func() {}, nil
+	}
+	lockKey := c.key(qName + LockSuffix)
+	token := NewMsgID()
+	acquired, err := c.redisCli.SetNX(c.ctx, lockKey, token, c.lockTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s queue : %w", qName, redisErr(err))
+	}
+	if !acquired {
+		return nil, fmt.Errorf("%w : %s", ErrQueueLocked, qName)
+	}
+	// Refresh the lock well before it expires, so it's held through the
+	// queue runs longer than lockTTL
+	done := make(chan struct{})
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		interval := c.lockTTL / 3
+		if interval <= 0 {
+			interval = c.lockTTL
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+				c.refreshLock(qName, lockKey, token)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-refreshed
+		// Lock may have expired and been taken by another consumer meanwhile,
+		// only the lock held with the token is released. It's released on the
+		// client context cancellation too, so it isn't held till it expires
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		err := c.redisCli.Eval(ctx, unlockScript, []string{lockKey}, token).Err()
+		if err != nil {
+			c.logger.Errorf("Error unlocking %s queue : %v", qName, err)
+		}
+	}, nil
+}
+
+// refreshLock extends the qName queue lock held with the token by lockTTL
+func (c *Client) refreshLock(qName string, lockKey string, token string) {
+	held, err := c.redisCli.Eval(c.ctx, refreshLockScript, []string{lockKey}, token, c.lockTTL.Milliseconds()).Int64()
+	if err != nil {
+		c.logger.Errorf("Error refreshing %s queue lock : %v", qName, err)
+		return
+	}
+	if held == 0 {
+		c.logger.Errorf("Lock of %s queue expired while it's executed", qName)
+	}
+}
+
+// ExecuteMessage executes the first message named msgName of the qName queue
+// on demand, e.g from an admin UI. Message is removed from the queue on success
+// and dead lettered on failure like the queue execution, it returns
+// ErrMsgNotFound if the message isn't in the queue
+func (c *Client) ExecuteMessage(qName string, msgName string) (ExecResult, error) {
+	msg, rawMsg, err := c.findMsg(qName, byName(msgName))
+	if err != nil {
+		return ExecResult{Name: msgName}, err
+	}
+	result, _ := c.executeMsg(msg, storedMsg{raw: rawMsg}, qName)
+	return result, result.Err
+}
+
+// RawExecute performs the HTTP request based on request params
+func (c *Client) RawExecute(msg InputMsg, qName string) error {
+	result, _ := c.executeMsg(msg, storedMsg{}, qName)
+	return result.Err
+}
+
+// executeMsg performs the HTTP request based on request params and returns it's
+// result, it reports if the message is removed from the executed queue. stored
+// is the message as stored in the queue, empty if it's not read from the queue
+func (c *Client) executeMsg(msg InputMsg, stored storedMsg, qName string) (ExecResult, bool) {
+	result := ExecResult{Name: msg.Name}
+	// Request is built from the mutated copy, the stored message is kept as is
+	reqMsg := msg
+	if c.mutator != nil {
+		reqMsg = c.mutator(cloneMsg(msg))
+	}
+	var (
+		reqBody       []byte
+		formBody      bool
+		multipartType string
+	)
+	// Any method other than GET and HEAD carries the body if set
+	if reqMsg.ReqMethod != http.MethodGet && reqMsg.ReqMethod != http.MethodHead {
+		if len(reqMsg.Multipart) > 0 {
+			var err error
+			reqBody, multipartType, err = multipartBody(reqMsg.Multipart)
+			if err != nil {
+				result.Err = fmt.Errorf("error building multipart body for msg %s : %w", msg.Name, err)
+				return result, false
+			}
+		} else if reqMsg.Body != nil {
+			// send raw body as it is
+			reqBody = reqMsg.Body
+		} else if reqMsg.PostParam != nil {
+			// convert post params map into “URL encoded”
+			reqBody = []byte(reqMsg.PostParam.Encode())
+			formBody = true
+		}
+	}
+	var postBody io.Reader
+	if reqBody != nil {
+		postBody = bytes.NewReader(reqBody)
+	}
+	reqURL, err := mergeQuery(reqMsg.Url, reqMsg.QueryParam)
+	if err != nil {
+		result.Err = fmt.Errorf("error parsing url for msg %s : %w", msg.Name, err)
+		return result, false
+	}
+	// Cancelling the client context aborts the in-flight request
+	ctx := c.ctx
+	httpClient := c.httpClient
+	if reqMsg.Timeout > 0 {
+		// Message deadline replaces the client timeout, so it can be longer too
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(c.ctx, reqMsg.Timeout)
+		defer cancel()
+		msgClient := *c.httpClient
+		msgClient.Timeout = 0
+		httpClient = &msgClient
+	}
+	req, err := http.NewRequestWithContext(ctx, reqMsg.ReqMethod, reqURL, postBody)
+	if err != nil {
+		result.Err = fmt.Errorf("error creating HTTP request for msg %s : %w", msg.Name, err)
+		return result, false
+	}
+
+	// Add all request headers to the http request, headers are copied as the
+	// cookie jar adds it's cookies to the request headers
+	if reqMsg.Headers != nil {
+		req.Header = reqMsg.Headers.Clone()
+	}
+	// Add the default headers not set by the message
+	for key, values := range c.defHeaders {
+		if len(req.Header.Values(key)) == 0 {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+	// Set the form content type of the post params, unless set explicitly
+	if formBody && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if multipartType != "" {
+		req.Header.Set("Content-Type", multipartType)
+	}
+	if reqMsg.BasicAuthUser != "" || reqMsg.BasicAuthPass != "" {
+		req.SetBasicAuth(reqMsg.BasicAuthUser, reqMsg.BasicAuthPass)
+	}
+
+	// Log the request in place of sending it, message stays in the queue
+	if c.dryRun {
+		c.logger.Printf("Dry run msg %s : %s %s headers %v body %s", msg.Name, req.Method, req.URL, c.redactHeader(req.Header), reqBody)
+		if !msg.SkipResponseStore {
+			c.MessageResponse(msg.Name, ResponseRecord{Body: DryRunBody, ExecutedAt: time.Now()})
+		}
+		result.Success = true
+		return result, false
+	}
+
+	// Skip the message already executed successfully
+	if c.cacheOK && msg.ID != "" {
+		record, err := c.MessageResponseDetailByID(msg.ID)
+		if err == nil && record.StatusCode >= 200 && record.StatusCode < 300 {
+			c.logger.Printf("Request msg %s, already succeeded with status %d", msg.Name, record.StatusCode)
+			removed := c.handleDead(msg, stored, qName, false, record.StatusCode, "")
+			if removed && c.onSuccess != nil {
+				c.onSuccess(msg, nil)
+			}
+			result.StatusCode = record.StatusCode
+			result.Success = true
+			return result, removed
+		}
+		if err != nil && !errors.Is(err, ErrMsgNotFound) {
+			c.logger.Errorf("Error fetching cached response of msg %s : %v", msg.Name, err)
+		}
+	}
+
+	// Wait for the rate limit, message stays in the queue if cancelled meanwhile
+	if err := c.limiter.wait(c.ctx); err != nil {
+		result.Err = fmt.Errorf("stopped executing msg %s : %w", msg.Name, err)
+		return result, false
+	}
+
+	// Wrap the request in a span and propagate it's context to the upstream
+	var span trace.Span
+	if c.tracer != nil {
+		ctx, span = c.tracer.Start(ctx, "dlq.execute "+qName,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(req.Method),
+				semconv.HTTPURLKey.String(req.URL.String()),
+				attribute.String("dlq.queue", qName),
+				attribute.String("dlq.msg", msg.Name),
+			))
+		defer span.End()
+		req = req.WithContext(ctx)
+		c.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+
+	// Sign last, so the signature covers the final headers
+	if c.signRequest != nil {
+		if err := c.signRequest(req); err != nil {
+			if span != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			result.Err = fmt.Errorf("error signing HTTP request for msg %s : %w", msg.Name, err)
+			return result, false
+		}
+	}
+
+	// Timed out requests are returned as error like any other failed request
+	start := time.Now()
+	res, err := httpClient.Do(req)
+	if err != nil {
+		if c.metrics != nil {
+			c.metrics.MsgExecuted(qName, StatusNetworkError, false, time.Since(start))
+		}
+		if span != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		result.Err = fmt.Errorf("error making HTTP request for msg %s : %w", msg.Name, err)
+		removed := false
+		// Route connection failures to the network dead queue, cancelled
+		// requests stay in the queue
+		if c.ctx.Err() == nil && Find(c.msgDeadHTTP(msg), StatusNetworkError) {
+			removed = c.handleDead(msg, stored, qName, true, StatusNetworkError, err.Error())
+		}
+		if c.onResult != nil {
+			c.onResult(msg, nil, result.Err)
+		}
+		return result, removed
+	}
+	defer res.Body.Close()
+
+	body, truncated, err := c.readBody(res.Body)
+	if err != nil {
+		c.logger.Errorf("Error reading response body %v", err)
+	}
+	// Store response data under message name and ID
+	record := ResponseRecord{
+		StatusCode:  res.StatusCode,
+		Headers:     res.Header,
+		ExecutedAt:  time.Now(),
+		Truncated:   truncated,
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	// Binary body is kept as bytes as the string body gets corrupted on JSON marshal
+	if utf8.Valid(body) {
+		record.Body = string(body)
+	} else {
+		record.RawBody = body
+	}
+	if !msg.SkipResponseStore {
+		c.MessageResponse(msg.Name, record)
+		if msg.ID != "" {
+			c.MessageResponse(msg.ID, record)
+		}
+	}
+
+	result.StatusCode = res.StatusCode
+	dead := Find(c.msgDeadHTTP(msg), res.StatusCode)
+	// Message DeadHTTP takes precedence over IsDead
+	if c.isDead != nil && msg.DeadHTTP == nil {
+		dead = c.isDead(res, body)
+	}
+	result.Success = !dead
+	if span != nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+		if dead {
+			span.SetStatus(codes.Error, res.Status)
+		}
+	}
+	// Keep the failed attempt response, the one under message name is
+	// overwritten by the next retry
+	if dead && c.keepFailed > 0 && !msg.SkipResponseStore {
+		c.failedResponse(msg, record)
+	}
+	if c.metrics != nil {
+		c.metrics.MsgExecuted(qName, res.StatusCode, result.Success, time.Since(start))
+	}
+	removed := c.handleDead(msg, stored, qName, dead, res.StatusCode, res.Status)
+	if !dead && removed && c.onSuccess != nil {
+		c.onSuccess(msg, res)
+	}
+	if c.onResult != nil {
+		c.onResult(msg, res, nil)
+	}
+	return result, removed
+}
+
+// redactHeader copies the header with the values of redact headers masked
+// for logging
+func (c *Client) redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range c.redact {
+		if _, ok := redacted[http.CanonicalHeaderKey(name)]; ok {
+			redacted[http.CanonicalHeaderKey(name)] = []string{RedactedValue}
+		}
+	}
+	return redacted
+}
+
+// cloneMsg copies the message along with it's headers, params and body
+func cloneMsg(msg InputMsg) InputMsg {
+	msg.Headers = msg.Headers.Clone()
+	msg.PostParam = cloneValues(msg.PostParam)
+	msg.QueryParam = cloneValues(msg.QueryParam)
+	if msg.Body != nil {
+		msg.Body = append([]byte{}, msg.Body...)
+	}
+	if msg.Multipart != nil {
+		parts := make([]MultipartPart, len(msg.Multipart))
+		for i, part := range msg.Multipart {
+			if part.Content != nil {
+				part.Content = append([]byte{}, part.Content...)
+			}
+			parts[i] = part
+		}
+		msg.Multipart = parts
+	}
+	if msg.DeadHTTP != nil {
+		msg.DeadHTTP = append([]int{}, msg.DeadHTTP...)
+	}
+	return msg
+}
+
+// cloneValues copies the url values
+func cloneValues(values url.Values) url.Values {
+	if values == nil {
+		return nil
+	}
+	cloned := make(url.Values, len(values))
+	for key, value := range values {
+		cloned[key] = append([]string(nil), value...)
+	}
+	return cloned
+}
+
+// multipartBody encodes the parts as multipart/form-data body and returns it
+// along with it's content type
+func multipartBody(parts []MultipartPart) ([]byte, string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for _, part := range parts {
+		disposition := fmt.Sprintf(`form-data; name="%s"`, quote.Replace(part.FieldName))
+		contentType := part.ContentType
+		if part.FileName != "" {
+			disposition += fmt.Sprintf(`; filename="%s"`, quote.Replace(part.FileName))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", disposition)
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = w.Write(part.Content)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), writer.FormDataContentType(), nil
+}
+
+// mergeQuery appends query params to the url, keeping the existing query string
+func mergeQuery(rawURL string, queryParam url.Values) (string, error) {
+	if len(queryParam) == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for key, values := range queryParam {
+		for _, value := range values {
+			query.Add(key, value)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// storedMsg is the executed message as stored in the queue
+type storedMsg struct {
+	// raw is the member the message is removed by, the message stored in an
+	// older format doesn't match it's re-marshal
+	raw string
+	// popped is set for the message already taken off the queue
+	popped bool
+}
+
+// removeMsg removes the first occurrence of the stored message from the queue
+// and reports if it's removed. Removal by value is safe with concurrent
+// producers and consumers on the queue unlike trimming the head. msg is
+// marshalled only if the raw stored message is empty
+func (c *Client) removeMsg(qName string, msg InputMsg, stored storedMsg) (bool, error) {
+	if stored.popped {
+		return true, nil
+	}
+	var member interface{} = stored.raw
+	if stored.raw == "" {
+		msgInput, err := marshalMsg(c.codec, msg)
+		if err != nil {
+			return false, err
+		}
+		member = msgInput
+	}
+	removed, err := c.redisCli.LRem(c.ctx, c.key(qName), 1, member).Result()
+	if err != nil {
+		return false, redisErr(err)
+	}
+	return removed > 0, nil
+}
+
+// deadExpired checks if the first failure of the dead message is older than
+// deadMaxAge
+func (c *Client) deadExpired(msg InputMsg) bool {
+	if c.deadMaxAge == 0 {
+		return false
+	}
+	firstFailed := msg.FailedAt
+	if len(msg.Attempts) > 0 {
+		firstFailed = msg.Attempts[0].Timestamp
+	}
+	return time.Since(firstFailed) > c.deadMaxAge
+}
+
+// expireDeadMsg moves the expired dead message of qName to the failed queue
+func (c *Client) expireDeadMsg(qName string, msg InputMsg, rawMsg string) error {
+	err := c.moveMsg(qName, QueueFailed, rawMsg, msg)
+	if errors.Is(err, ErrMsgNotFound) {
+		// Message is already removed by another consumer
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("Request msg %s, expired post %v in dead queue", msg.Name, c.deadMaxAge)
+	if c.onFailure != nil {
+		c.onFailure(msg, msg.Attempts)
+	}
+	return nil
+}
+
+// retryEligible checks if the dead message backoff delay is over
+func (c *Client) retryEligible(msg InputMsg) bool {
+	if c.backoffBase == 0 {
+		return true
+	}
+	return !time.Now().Before(msg.FailedAt.Add(c.retryDelay(msg)))
+}
+
+// retryDelay computes the backoff delay of the dead message with jitter if set
+// jitter is derived from the message failure, so it's the same across the runs
+func (c *Client) retryDelay(msg InputMsg) time.Duration {
+	delay := c.backoffDelay(msg.Retries)
+	if !c.jitter || delay <= 0 {
+		return delay
+	}
+	h := fnv.New64a()
+	h.Write([]byte(msg.ID + strconv.FormatInt(msg.FailedAt.UnixNano(), 10)))
+	return time.Duration(h.Sum64() % uint64(delay+1))
+}
+
+// backoffDelay computes backoffBase * 2^retries capped at backoffMax
+func (c *Client) backoffDelay(retries int) time.Duration {
+	delay := c.backoffBase
+	for i := 0; i < retries; i++ {
+		// Stop doubling on reaching the max delay or duration overflow
+		if (c.backoffMax > 0 && delay >= c.backoffMax) || delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+	}
+	if c.backoffMax > 0 && delay > c.backoffMax {
+		delay = c.backoffMax
+	}
+	return delay
+}
+
+// isDeadQueue checks if qName is one of the dead letter queues of the request
+// queue, which are named by the status code alone
+func (c *Client) isDeadQueue(qName string) bool {
+	for _, code := range c.deadHTTP {
+		if qName == strconv.Itoa(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeadMsg checks if msg is read from a dead queue i.e qName is the dead queue
+// of it's origin queue for it's last failure. Queue names aren't parsed as a
+// request queue may be named like a dead queue e.g "shard:0". Message stored
+// without the origin queue or attempts is dead in the request queue dead queues
+func (c *Client) isDeadMsg(qName string, msg InputMsg) bool {
+	if msg.OriginQueue == "" || len(msg.Attempts) == 0 {
+		return c.isDeadQueue(qName)
+	}
+	lastAttempt := msg.Attempts[len(msg.Attempts)-1]
+	return qName == c.DeadQueueName(msg.OriginQueue, c.deadCode(lastAttempt.StatusCode))
+}
+
+// deadCode returns the dead queue status code of the failed statusCode, status
+// codes outside deadHTTP are dead lettered to the StatusCustomDead queue
+func (c *Client) deadCode(statusCode int) int {
+	if !Find(c.deadHTTP, statusCode) {
+		return StatusCustomDead
+	}
+	return statusCode
+}
+
+// MessageResponse stores response record of the request message, it expires
+// post responseTTL if set
+func (c *Client) MessageResponse(msgName string, record ResponseRecord) {
+	response, err := c.codec.Marshal(record)
+	if err != nil {
+		c.logger.Errorf("Error marshalling response for the req message %s", msgName)
+		return
+	}
+	err = c.redisCli.Set(c.ctx, c.responseKey(msgName), string(response), c.responseTTL).Err()
+	if err != nil {
+		c.logger.Errorf("Error updating response for the req message %s", msgName)
+	}
+}
+
+// failedResponse stores the response record of the failed msg attempt and
+// deletes the attempt past the keepFailed retention
+func (c *Client) failedResponse(msg InputMsg, record ResponseRecord) {
+	attempt := len(msg.Attempts) + 1
+	c.MessageResponse(attemptKey(msg.Name, attempt), record)
+	if attempt > c.keepFailed {
+		err := c.redisCli.Del(c.ctx, c.responseKey(attemptKey(msg.Name, attempt-c.keepFailed))).Err()
+		if err != nil {
+			c.logger.Errorf("Error deleting failed response for the req message %s : %v", msg.Name, err)
+		}
+	}
+}
+
+// attemptKey is the key of the msgName failed attempt response
+func attemptKey(msgName string, attempt int) string {
+	return fmt.Sprintf("%s:%d", msgName, attempt)
+}
+
+// readBody reads the response body up to maxResBytes if set, it reports if
+// the body is truncated
+func (c *Client) readBody(body io.Reader) ([]byte, bool, error) {
+	if c.maxResBytes <= 0 {
+		data, err := ioutil.ReadAll(body)
+		return data, false, err
+	}
+	// Read a byte past the limit to detect the truncation
+	data, err := ioutil.ReadAll(io.LimitReader(body, c.maxResBytes+1))
+	if int64(len(data)) > c.maxResBytes {
+		return data[:c.maxResBytes], true, err
+	}
+	return data, false, err
+}
+
+// HandleDeadQueue creates/update dead queue to retry later
+func (c *Client) HandleDeadQueue(res *http.Response, msg InputMsg, qName string) {
+	c.handleDead(msg, storedMsg{}, qName, Find(c.msgDeadHTTP(msg), res.StatusCode), res.StatusCode, res.Status)
+}
+
+// msgDeadHTTP returns the dead status codes of the message, message DeadHTTP
+// overrides the client DeadHTTP if set
+func (c *Client) msgDeadHTTP(msg InputMsg) []int {
+	if msg.DeadHTTP != nil {
+		return msg.DeadHTTP
+	}
+	return c.deadHTTP
+}
+
+// handleDead moves the dead executed message to the dead queue of the statusCode
+// and removes it's stored message from the executed queue. Dead message with statusCode
+// outside deadHTTP is moved to the StatusCustomDead queue. It reports if the
+// message is removed from the executed queue
+func (c *Client) handleDead(msg InputMsg, stored storedMsg, qName string, dead bool, statusCode int, status string) bool {
+	// Keep executed message as is for it's removal from the queue
+	executedMsg := msg
+	// Dead lettering is disabled by empty deadHTTP, dead message is only removed
+	if dead && len(c.deadHTTP) == 0 {
+		c.logger.Printf("Request msg %s, failed with status %s", msg.Name, status)
+		dead = false
+	}
+	// Create/add dead letter queue based on user input for deadHTTP
+	if dead {
+		// Alert user with failed status for HTTP request
+		c.logger.Printf("Request msg %s, failed with status %s", msg.Name, status)
+		// Count retry of the message executed from the dead queue, else keep
+		// the queue it originated from. Message pushed back to the origin
+		// queue is retried from there, it's first failure isn't a retry
+		inDead := c.isDeadMsg(qName, msg)
+		if inDead || (c.deadToMain && len(msg.Attempts) > 0) {
+			msg.Retries++
+		}
+		if !inDead && msg.OriginQueue == "" {
+			msg.OriginQueue = qName
+		}
+		// Add failed messages to dead letter queue of the origin queue
+		qkey := c.DeadQueueName(msg.OriginQueue, c.deadCode(statusCode))
+		if c.deadToMain {
+			qkey = msg.OriginQueue
+			if qkey == "" {
+				qkey = c.queueName
+			}
+		}
+		msg.FailedAt = time.Now()
+		// Add failed execution to the message retry trail
+		attempt := Attempt{Timestamp: msg.FailedAt, StatusCode: statusCode}
+		if statusCode == StatusNetworkError {
+			attempt.Error = status
+		}
+		msg.Attempts = append(msg.Attempts, attempt)
+		// Move message to failed queue once all retries are exhausted
+		if c.maxRetries > 0 && msg.Retries >= c.maxRetries {
+			c.logger.Printf("Request msg %s, exhausted %d retries", msg.Name, msg.Retries)
+			qkey = QueueFailed
+		}
+		// Move the message that won't succeed on retry to failed queue
+		if c.retryable != nil && !Find(c.retryable, statusCode) {
+			c.logger.Printf("Request msg %s, failed with non-retryable status %d", msg.Name, statusCode)
+			qkey = QueueFailed
+		}
+		var (
+			added    = true
+			replaced bool
+			err      error
+		)
+		if qkey == qName && !stored.popped {
+			// Message failing again into the queue it's executed from is
+			// replaced in one step, so it isn't capped by maxDeadSize against
+			// itself or trimmed before it's removal
+			replaced = true
+			err = c.replaceMsg(qName, executedMsg, stored, msg)
+		} else if c.maxDeadSize > 0 && qkey != QueueFailed && !c.deadToMain {
+			added, err = c.pushDead(qkey, msg)
+		} else {
+			err = c.SetQueue(qkey, msg)
+		}
+		if replaced && errors.Is(err, ErrMsgNotFound) {
+			c.logger.Errorf("Request msg %s, not found in %s queue for removal", msg.Name, qName)
+			return false
+		}
+		if err != nil {
+			// Keep the message in current queue to be executed again
+			c.logger.Errorf("Error adding dead queue : %v", err)
+			return false
+		}
+		if added && c.metrics != nil {
+			c.metrics.MsgDeadLettered(qkey, statusCode)
+			c.updateDepth(qkey)
+		}
+		if qkey == QueueFailed && c.onFailure != nil {
+			c.onFailure(msg, msg.Attempts)
+		}
+		if replaced {
+			return true
+		}
+	}
+	// Delete executed message from the redis list
+	removed, err := c.removeMsg(qName, executedMsg, stored)
+	if err != nil {
+		c.logger.Errorf("Error removing the queue member: %v", err)
+	} else if !removed {
+		c.logger.Errorf("Request msg %s, not found in %s queue for removal", msg.Name, qName)
+	}
+	if c.metrics != nil {
+		c.updateDepth(qName)
+	}
+	return removed
+}
+
+// replaceMsg removes the stored executedMsg from qName queue and pushes msg to
+// it's tail atomically, it returns ErrMsgNotFound if the message isn't in the queue
+func (c *Client) replaceMsg(qName string, executedMsg InputMsg, stored storedMsg, msg InputMsg) error {
+	rawMsg := stored.raw
+	if rawMsg == "" {
+		msgInput, err := marshalMsg(c.codec, executedMsg)
+		if err != nil {
+			return err
+		}
+		rawMsg = string(msgInput)
+	}
+	return c.moveMsg(qName, qName, rawMsg, msg)
+}
+
+// pushDead adds the msg to the deadQName queue within maxDeadSize as per the
+// overflow policy, it reports if the message is added
+func (c *Client) pushDead(deadQName string, msg InputMsg) (bool, error) {
+	if c.overflow == OverflowReject {
+		length, err := c.QueueLength(deadQName)
+		if err != nil {
+			return false, err
+		}
+		if length >= int64(c.maxDeadSize) {
+			c.logger.Printf("Dead queue %s is full, dropping msg %s", deadQName, msg.Name)
+			c.msgDropped(deadQName, 1)
+			return false, nil
+		}
+		return true, c.SetQueue(deadQName, msg)
+	}
+	msgInput, err := marshalMsg(c.codec, msg)
+	if err != nil {
+		return false, err
+	}
+	length, err := c.redisCli.RPush(c.ctx, c.key(deadQName), msgInput).Result()
+	if err != nil {
+		return false, redisErr(err)
+	}
+	if dropped := length - int64(c.maxDeadSize); dropped > 0 {
+		err = c.redisCli.LTrim(c.ctx, c.key(deadQName), -int64(c.maxDeadSize), -1).Err()
+		if err != nil {
+			c.logger.Errorf("Error trimming %s dead queue : %v", deadQName, err)
+			return true, nil
+		}
+		c.logger.Printf("Dead queue %s is full, dropped %d oldest msgs", deadQName, dropped)
+		c.msgDropped(deadQName, int(dropped))
+	}
+	return true, nil
+}
+
+// msgDropped reports the dropped dead messages to metrics if supported
+func (c *Client) msgDropped(deadQName string, count int) {
+	if m, ok := c.metrics.(DropMetrics); ok {
+		m.MsgDropped(deadQName, count)
+	}
+}
+
+// updateDepth reports the current qName queue length to metrics
+func (c *Client) updateDepth(qName string) {
+	depth, err := c.QueueLength(qName)
+	if err != nil {
+		c.logger.Errorf("Error fetching %s queue length : %v", qName, err)
+		return
+	}
+	c.metrics.QueueDepth(qName, depth)
+}
+
+// Fetch message response status, returns the stored response record json as
+// encoded by the codec, uncompressed if it's stored compressed. It returns
+// ErrMsgNotFound if the message response is not stored
+func (c *Client) MessageStatus(msgName string) (string, error) {
+	val, err := c.redisCli.Get(c.ctx, c.responseKey(msgName)).Result()
+	if err == redis.Nil {
+		return "", fmt.Errorf("%w : no response for %s", ErrMsgNotFound, msgName)
+	}
+	if err != nil {
+		return "", redisErr(err)
+	}
+	data, err := decompress([]byte(val))
+	if err != nil {
+		return "", fmt.Errorf("error decompressing response of %s : %w", msgName, err)
+	}
+	return string(data), nil
+}
+
+// MessageStatusByID fetches message response status by message ID
+// Unlike message name, ID is never shared by two messages
+func (c *Client) MessageStatusByID(msgID string) (string, error) {
+	return c.MessageStatus(msgID)
+}
+
+// MessageResponseDetailByID fetches the response record of the executed message by ID
+func (c *Client) MessageResponseDetailByID(msgID string) (ResponseRecord, error) {
+	return c.MessageResponseDetail(msgID)
+}
+
+// MessageResponseDetail fetches the response record of the executed message
+func (c *Client) MessageResponseDetail(msgName string) (ResponseRecord, error) {
+	var record ResponseRecord
+	val, err := c.MessageStatus(msgName)
+	if err != nil {
+		return record, err
+	}
+	err = c.codec.Unmarshal([]byte(val), &record)
+	if err != nil {
+		return record, fmt.Errorf("%w : %v", ErrMarshal, err)
+	}
+	return record, nil
+}
+
+// FailedResponseDetail fetches the response record of the failed attempt of
+// the message, attempts are numbered from 1. Responses are kept only with
+// KeepFailedResponses set
+func (c *Client) FailedResponseDetail(msgName string, attempt int) (ResponseRecord, error) {
+	return c.MessageResponseDetail(attemptKey(msgName, attempt))
+}
+
+// MessageResponseBytes fetches the response body of the executed message as is
+// along with it's content type, e.g for binary responses
+func (c *Client) MessageResponseBytes(msgName string) ([]byte, string, error) {
+	record, err := c.MessageResponseDetail(msgName)
+	if err != nil {
+		return nil, "", err
+	}
+	if record.RawBody != nil {
+		return record.RawBody, record.ContentType, nil
+	}
+	return []byte(record.Body), record.ContentType, nil
+}
+
+// Delete message by message name from request queue
+func (c *Client) DeleteReqMsg(msgName string) error {
+	return c.DelMsg(c.queueName, msgName)
+}
+
+// Delete message by message ID from request queue
+func (c *Client) DeleteReqMsgByID(msgID string) error {
+	return c.DelMsgByID(c.queueName, msgID)
+}
+
+// Delete message by name from Deadletter queue
+func (c *Client) DeleteDeadMsg(msgName string) error {
+	return c.DeleteDeadMsgOf(c.queueName, msgName)
+}
+
+// DeleteDeadMsgOf deletes message by name from the dead queues of the qName
+// request queue
+func (c *Client) DeleteDeadMsgOf(qName string, msgName string) error {
+	// Search and delete msg name from all declared dead http queue
+	deleted := false
+	for _, value := range c.deadHTTP {
+		err := c.DelMsg(c.DeadQueueName(qName, value), msgName)
+		if errors.Is(err, ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		deleted = true
+	}
+	if !deleted {
+		return fmt.Errorf("%w : %s in the dead queues", ErrMsgNotFound, msgName)
+	}
+	return nil
+}
+
+// DeleteDeadMsgs deletes messages by names from all the dead letter queues in
+// two redis round-trips, names not found in any dead queue are skipped
+func (c *Client) DeleteDeadMsgs(names []string) error {
+	return c.DeleteDeadMsgsOf(c.queueName, names)
+}
+
+// DeleteDeadMsgsOf is DeleteDeadMsgs for the dead queues of the qName request
+// queue
+func (c *Client) DeleteDeadMsgsOf(qName string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	delNames := make(map[string]bool, len(names))
+	for _, name := range names {
+		delNames[name] = true
+	}
+	// Fetch all the dead queues at once
+	deadQueues := make(map[string]*redis.StringSliceCmd)
+	_, err := c.redisCli.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for _, value := range c.deadHTTP {
+			deadQName := c.DeadQueueName(qName, value)
+			deadQueues[deadQName] = pipe.LRange(c.ctx, c.key(deadQName), 0, -1)
+		}
+		return nil
+	})
+	if err != nil {
+		return redisErr(err)
+	}
+	// Remove the raw messages matching the names at once
+	_, err = c.redisCli.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for _, value := range c.deadHTTP {
+			deadQName := c.DeadQueueName(qName, value)
+			for _, rawMsg := range deadQueues[deadQName].Val() {
+				msg, err := unmarshalMsg(c.codec, rawMsg)
+				if err != nil || !delNames[msg.Name] {
+					continue
+				}
+				pipe.LRem(c.ctx, c.key(deadQName), 1, rawMsg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return redisErr(err)
+	}
+	return nil
+}
+
+// RequeueDeadMessage moves message by name from the dead letter queue back to
+// the queue it originated from, else the request queue, retry count of the
+// message is reset
+func (c *Client) RequeueDeadMessage(msgName string) error {
+	return c.RequeueDeadMessageOf(c.queueName, msgName)
+}
+
+// RequeueDeadMessageOf is RequeueDeadMessage for the dead queues of the qName
+// request queue
+func (c *Client) RequeueDeadMessageOf(qName string, msgName string) error {
+	for _, value := range c.deadHTTP {
+		deadQName := c.DeadQueueName(qName, value)
+		msg, rawMsg, err := c.findMsg(deadQName, byName(msgName))
+		if errors.Is(err, ErrMsgNotFound) || errors.Is(err, ErrQueueEmpty) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return c.requeueMsg(deadQName, msg, rawMsg)
+	}
+	return fmt.Errorf("%w : %s in the dead queues", ErrMsgNotFound, msgName)
+}
+
+// AttemptCount fetches the number of recorded attempts of the message by name
+// from the dead letter queues and the failed queue
+func (c *Client) AttemptCount(msgName string) (int, error) {
+	return c.AttemptCountOf(c.queueName, msgName)
+}
+
+// AttemptCountOf is AttemptCount for the dead queues of the qName request queue
+func (c *Client) AttemptCountOf(qName string, msgName string) (int, error) {
+	queues := []string{}
+	for _, value := range c.deadHTTP {
+		queues = append(queues, c.DeadQueueName(qName, value))
+	}
+	queues = append(queues, QueueFailed)
+	for _, queue := range queues {
+		msg, found, err := c.MsgDetail(queue, msgName)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return len(msg.Attempts), nil
+		}
+	}
+	return 0, fmt.Errorf("%w : %s in the dead queues", ErrMsgNotFound, msgName)
+}
+
+// RequeueAllDead moves all the messages of all the dead letter queues back to
+// the queue they originated from, else the request queue, and returns the
+// number of moved messages
+func (c *Client) RequeueAllDead() (int, error) {
+	return c.RequeueAllDeadOf(c.queueName)
+}
+
+// RequeueAllDeadOf is RequeueAllDead for the dead queues of the qName request
+// queue
+func (c *Client) RequeueAllDeadOf(qName string) (int, error) {
+	moved := 0
+	for _, value := range c.deadHTTP {
+		deadQName := c.DeadQueueName(qName, value)
+		queSlice, err := c.redisCli.LRange(c.ctx, c.key(deadQName), 0, -1).Result()
+		if err != nil {
+			return moved, fmt.Errorf("error fetching %s queue : %w", deadQName, redisErr(err))
+		}
+		msgs, raws := c.decodeQueue(deadQName, queSlice)
+		for i, msg := range msgs {
+			err := c.requeueMsg(deadQName, msg, raws[i])
+			if errors.Is(err, ErrMsgNotFound) {
+				// Message is already removed by another consumer
+				continue
+			}
+			if err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// requeueMsg moves dead msg of qName to the queue it originated from with
+// retry count reset
+func (c *Client) requeueMsg(qName string, msg InputMsg, rawMsg string) error {
+	reqMsg := msg
+	reqMsg.Retries = 0
+	reqMsg.FailedAt = time.Time{}
+	originQueue := msg.OriginQueue
+	if originQueue == "" {
+		originQueue = c.queueName
+	}
+	return c.moveMsg(qName, originQueue, rawMsg, reqMsg)
+}
+
+// MoveMessage moves message by name from fromQueue to the tail of toQueue
+func (c *Client) MoveMessage(fromQueue, toQueue, msgName string) error {
+	msg, rawMsg, err := c.findMsg(fromQueue, byName(msgName))
+	if err != nil {
+		return err
+	}
+	return c.moveMsg(fromQueue, toQueue, rawMsg, msg)
+}
+
+// moveMsg removes rawMsg from fromQueue and pushes movedMsg to toQueue atomically,
+// it returns ErrMsgNotFound and pushes nothing if rawMsg isn't in fromQueue
+func (c *Client) moveMsg(fromQueue, toQueue string, rawMsg string, movedMsg InputMsg) error {
+	toMsg, err := marshalMsg(c.codec, movedMsg)
+	if err != nil {
+		return err
+	}
+	var removed int64
+	if _, ok := c.redisCli.(*redis.ClusterClient); ok {
+		// Queues may be on different cluster slots where the script can't run,
+		// message is pushed post it's removal
+		removed, err = c.redisCli.LRem(c.ctx, c.key(fromQueue), 1, rawMsg).Result()
+		if err == nil && removed > 0 {
+			err = c.redisCli.RPush(c.ctx, c.key(toQueue), toMsg).Err()
+		}
+	} else {
+		removed, err = c.redisCli.Eval(c.ctx, moveScript, []string{c.key(fromQueue), c.key(toQueue)}, rawMsg, toMsg).Int64()
+	}
+	if err != nil {
+		return redisErr(err)
+	}
+	if removed == 0 {
+		return fmt.Errorf("%w in the %s queue : %s", ErrMsgNotFound, fromQueue, movedMsg.Name)
+	}
+	return nil
+}
+
+// Remove message from the requested queue, it returns ErrMsgNotFound if the
+// message is not in the queue
+func (c *Client) DelMsg(queName string, msgName string) error {
+	// Fetch message detail with message name
+	_, rawMsg, err := c.findMsg(queName, byName(msgName))
+	if err != nil {
+		return err
+	}
+	return c.delMsgDetail(queName, rawMsg)
+}
+
+// Remove message by ID from the requested queue
+func (c *Client) DelMsgByID(queName string, msgID string) error {
+	_, rawMsg, err := c.findMsg(queName, byID(msgID))
+	if err != nil {
+		return err
+	}
+	return c.delMsgDetail(queName, rawMsg)
+}
+
+// delMsgDetail removes all occurrences of the raw message from the queue
+func (c *Client) delMsgDetail(queName string, rawMsg string) error {
+	err := c.redisCli.LRem(c.ctx, c.key(queName), 0, rawMsg).Err()
+	if err != nil {
+		return redisErr(err)
+	}
+	return nil
+}
+
+// Clear complete request queue
+func (c *Client) ClearReqQueue() error {
+	return c.ClearQueue(c.queueName)
+}
+
+// Cleat complete dead letter queue
+func (c *Client) ClearDeadQueue() error {
+	return c.ClearDeadQueueOf(c.queueName)
+}
+
+// ClearDeadQueueOf clears the dead queues of the qName request queue
+func (c *Client) ClearDeadQueueOf(qName string) error {
+	for _, value := range c.deadHTTP {
+		err := c.ClearQueue(c.DeadQueueName(qName, value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear complete failed queue
+func (c *Client) ClearFailedQueue() error {
+	return c.ClearQueue(QueueFailed)
+}
+
+// ClearAllQueues clears the request queue, delayed and priority messages, all
+// the dead letter queues, the failed and the corrupt queue. Stored responses
+// are kept
+func (c *Client) ClearAllQueues() error {
+	return c.ClearAllQueuesOf(c.queueName)
+}
+
+// ClearAllQueuesOf clears the qName request queue, it's priority messages and
+// dead letter queues. The delayed messages, the failed and the corrupt queue
+// shared by all the request queues are cleared only for the client QueueName
+func (c *Client) ClearAllQueuesOf(qName string) error {
+	queues := []string{qName, priorityQueue(qName)}
+	if qName == c.queueName {
+		queues = []string{qName, c.delayedQueue(), priorityQueue(qName), QueueFailed, QueueCorrupt}
+	}
+	for _, value := range c.deadHTTP {
+		queues = append(queues, c.DeadQueueName(qName, value))
+	}
+	// Delete each key separately as the keys may be on different cluster slots
+	_, err := c.redisCli.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for _, queue := range queues {
+			pipe.Del(c.ctx, c.key(queue))
+		}
+		return nil
+	})
+	return redisErr(err)
+}
+
+// Clear complete queue of the given key/queue name
+func (c *Client) ClearQueue(qName string) error {
+	err := c.redisCli.Del(c.ctx, c.key(qName)).Err()
+	if err != nil {
+		return redisErr(err)
+	}
+	return nil
+}
+
+// ClearQueuesByPattern deletes all the queues matching the glob pattern, e.g
+// "tenant1:*" and returns the number of deleted queues
+// Keys are scanned in batches with SCAN in place of blocking KEYS
+func (c *Client) ClearQueuesByPattern(pattern string) (int, error) {
+	var (
+		removed int64
+		mu      sync.Mutex
+	)
+	clearKeys := func(ctx context.Context, rdb redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := rdb.Scan(ctx, cursor, c.key(pattern), scanBatch).Result()
+			if err != nil {
+				return redisErr(err)
+			}
+			if len(keys) > 0 {
+				// Delete each key separately as the keys may be on different cluster slots
+				cmds, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+					for _, key := range keys {
+						pipe.Del(ctx, key)
+					}
+					return nil
+				})
+				if err != nil {
+					return redisErr(err)
+				}
+				mu.Lock()
+				for _, cmd := range cmds {
+					removed += cmd.(*redis.IntCmd).Val()
+				}
+				mu.Unlock()
+			}
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	}
+	var err error
+	// Scan each master node of the cluster
+	if cluster, ok := c.redisCli.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(c.ctx, func(ctx context.Context, master *redis.Client) error {
+			return clearKeys(ctx, master)
+		})
+	} else {
+		err = clearKeys(c.ctx, c.redisCli)
+	}
+	return int(removed), err
+}
+
+// QueueLength returns count of messages in the given queue
+func (c *Client) QueueLength(qName string) (int64, error) {
+	length, err := c.redisCli.LLen(c.ctx, c.key(qName)).Result()
+	if err != nil {
+		return 0, redisErr(err)
+	}
+	return length, nil
+}
+
+// IsQueueEmpty checks if the given queue has no messages, without fetching them
+func (c *Client) IsQueueEmpty(qName string) (bool, error) {
+	length, err := c.QueueLength(qName)
+	if err != nil {
+		return false, err
+	}
+	return length == 0, nil
+}
+
+// WaitForEmpty polls the qName queue length till it's empty, e.g in the
+// integration tests. It returns error wrapping context.DeadlineExceeded if
+// the queue isn't empty within the timeout
+func (c *Client) WaitForEmpty(qName string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(emptyPollInterval)
+	defer ticker.Stop()
+	for {
+		empty, err := c.IsQueueEmpty(qName)
+		if err != nil {
+			return err
+		}
+		if empty {
+			return nil
+		}
+		select {
+		case <-deadline.C:
+			return fmt.Errorf("%s queue not empty post %v : %w", qName, timeout, context.DeadlineExceeded)
+		case <-c.ctx.Done():
+			return fmt.Errorf("stopped waiting for %s queue : %w", qName, c.ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReqQueueLength returns count of messages in the request queue
+func (c *Client) ReqQueueLength() (int64, error) {
+	return c.QueueLength(c.queueName)
+}
+
+// DeadQueueLength returns total count of messages across all dead letter queues
+func (c *Client) DeadQueueLength() (int64, error) {
+	return c.DeadQueueLengthOf(c.queueName)
+}
+
+// DeadQueueLengthOf returns total count of messages across the dead letter
+// queues of the qName request queue
+func (c *Client) DeadQueueLengthOf(qName string) (int64, error) {
+	var total int64
+	for _, value := range c.deadHTTP {
+		length, err := c.QueueLength(c.DeadQueueName(qName, value))
+		if err != nil {
+			return 0, err
+		}
+		total += length
+	}
+	return total, nil
+}
+
+// Stats fetches the request, dead and failed queue lengths in single round-trip
+func (c *Client) Stats() (QueueStats, error) {
+	return c.StatsOf(c.queueName)
+}
+
+// StatsOf is Stats for the qName request queue and it's dead queues, the failed
+// queue is shared by all the request queues
+func (c *Client) StatsOf(qName string) (QueueStats, error) {
+	var reqLen, failedLen *redis.IntCmd
+	deadLens := make(map[int]*redis.IntCmd)
+	_, err := c.redisCli.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		reqLen = pipe.LLen(c.ctx, c.key(qName))
+		for _, value := range c.deadHTTP {
+			deadLens[value] = pipe.LLen(c.ctx, c.key(c.DeadQueueName(qName, value)))
+		}
+		failedLen = pipe.LLen(c.ctx, c.key(QueueFailed))
+		return nil
+	})
+	if err != nil {
+		return QueueStats{}, redisErr(err)
+	}
+	stats := QueueStats{
+		ReqQueue:   reqLen.Val(),
+		DeadQueues: make(map[int]int64),
+		Failed:     failedLen.Val(),
+	}
+	for code, cmd := range deadLens {
+		stats.DeadQueues[code] = cmd.Val()
+	}
+	return stats, nil
+}
+
+// Export dumps the request, dead, failed, delayed and priority messages to a
+// JSON QueueSnapshot, e.g for backup or moving the queues to another redis.
+// Queues are read one by one, so messages executed meanwhile may be missed
+func (c *Client) Export() ([]byte, error) {
+	var (
+		snapshot QueueSnapshot
+		err      error
+	)
+	snapshot.ReqQueue, err = c.GetQueue(c.queueName)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.DeadQueues, err = c.GetAllDeadMessages()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Failed, err = c.GetFailedQueue()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Delayed, err = c.sortedSetMsgs(c.delayedQueue())
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Priority, err = c.sortedSetMsgs(priorityQueue(c.queueName))
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("%w : %v", ErrMarshal, err)
+	}
+	return data, nil
+}
+
+// Import restores the queues from the JSON QueueSnapshot of Export. Messages
+// are appended to the current queues, clear them first with ClearAllQueues
+// for an exact restore
+func (c *Client) Import(data []byte) error {
+	var snapshot QueueSnapshot
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return fmt.Errorf("%w : %v", ErrMarshal, err)
+	}
+	// Request, dead and failed queues in the order written
+	qNames := []string{c.queueName}
+	qMsgs := [][]InputMsg{snapshot.ReqQueue}
+	codes := make([]int, 0, len(snapshot.DeadQueues))
+	for code := range snapshot.DeadQueues {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		qNames = append(qNames, c.DeadQueueName(c.queueName, code))
+		qMsgs = append(qMsgs, snapshot.DeadQueues[code])
+	}
+	qNames = append(qNames, QueueFailed)
+	qMsgs = append(qMsgs, snapshot.Failed)
+
+	// Marshal all the messages before writing any
+	members := make([][]interface{}, len(qMsgs))
+	for i, msgs := range qMsgs {
+		for _, msg := range msgs {
+			msgInput, err := marshalMsg(c.codec, msg)
+			if err != nil {
+				return err
+			}
+			members[i] = append(members[i], msgInput)
+		}
+	}
+	var delayed []*redis.Z
+	for _, msg := range snapshot.Delayed {
+		msgInput, err := marshalMsg(c.codec, msg)
+		if err != nil {
+			return err
+		}
+		delayed = append(delayed, &redis.Z{
+			Score:  float64(msg.ExecuteAt.UnixNano() / int64(time.Millisecond)),
+			Member: msgInput,
+		})
+	}
+	// Priority messages are scored by the time added, keep the exported order
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	var priority []*redis.Z
+	for i, msg := range snapshot.Priority {
+		msgInput, err := marshalMsg(c.codec, msg)
+		if err != nil {
+			return err
+		}
+		priority = append(priority, &redis.Z{Score: float64(now + int64(i)), Member: msgInput})
+	}
+	// Write each key separately as the keys may be on different cluster slots
+	_, err = c.redisCli.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for i, qName := range qNames {
+			if len(members[i]) > 0 {
+				pipe.RPush(c.ctx, c.key(qName), members[i]...)
+			}
+		}
+		if len(delayed) > 0 {
+			pipe.ZAdd(c.ctx, c.key(c.delayedQueue()), delayed...)
+		}
+		if len(priority) > 0 {
+			pipe.ZAdd(c.ctx, c.key(priorityQueue(c.queueName)), priority...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error importing queues : %w", redisErr(err))
+	}
+	return nil
+}
+
+// sortedSetMsgs fetches all messages of the delayed or priority sorted set
+func (c *Client) sortedSetMsgs(setName string) ([]InputMsg, error) {
+	members, err := c.redisCli.ZRange(c.ctx, c.key(setName), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s messages : %w", setName, redisErr(err))
+	}
+	var msgs []InputMsg
+	for _, member := range members {
+		msg, err := unmarshalMsg(c.codec, member)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// GetQueue fetches all messages in queue
+func (c *Client) GetQueue(qname string) ([]InputMsg, error) {
+	// Fetch redis list
+	queSlice, err := c.redisCli.LRange(c.ctx, c.key(qname), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s queue : %w", qname, redisErr(err))
+	}
+	msgs, _ := c.decodeQueue(qname, queSlice)
+	return msgs, nil
+}
+
+// IterateQueue pages through the qName queue from the head and calls fn for
+// each message, it stops on the first error returned by fn. Pages are fetched
+// by offset, so messages removed from the queue meanwhile shift the later pages
+func (c *Client) IterateQueue(qName string, fn func(InputMsg) error) error {
+	_, err := c.pageQueue(qName, func(msgs []InputMsg, _ []string) (int, error) {
+		for _, msg := range msgs {
+			if err := fn(msg); err != nil {
+				return 0, err
+			}
+		}
+		return len(msgs), nil
+	})
+	return err
+}
+
+// pageQueue fetches the messages of qName queue from the head in pages of
+// queuePageSize and calls process for each page. process returns the number
+// of messages of the page left in the queue, the next page starts past them.
+// Messages pushed to the queue tail post the first page are not visited.
+// process gets the raw messages as stored along the decoded ones.
+// It returns the number of messages visited
+func (c *Client) pageQueue(qName string, process func([]InputMsg, []string) (int, error)) (int64, error) {
+	var (
+		offset  int64
+		visited int64
+		total   int64 = -1
+	)
+	for total < 0 || visited < total {
+		size := queuePageSize
+		if total >= 0 && total-visited < size {
+			size = total - visited
+		}
+		queSlice, err := c.redisCli.LRange(c.ctx, c.key(qName), offset, offset+size-1).Result()
+		if err != nil {
+			return visited, fmt.Errorf("error fetching %s queue : %w", qName, redisErr(err))
+		}
+		if total < 0 {
+			// Queue fits in the first page, else bound the iteration to the
+			// current queue length
+			total = int64(len(queSlice))
+			if total == size {
+				total, err = c.redisCli.LLen(c.ctx, c.key(qName)).Result()
+				if err != nil {
+					return visited, fmt.Errorf("error fetching %s queue length : %w", qName, redisErr(err))
+				}
+			}
+		}
+		if len(queSlice) == 0 {
+			break
+		}
+		visited += int64(len(queSlice))
+		kept, err := process(c.decodeQueue(qName, queSlice))
+		if err != nil {
+			return visited, err
+		}
+		offset += int64(kept)
+	}
+	return visited, nil
+}
+
+// decodeQueue unmarshals the raw messages of qName queue, malformed messages
+// are moved to the corrupt queue. It returns the raw message as stored for each
+// decoded message, so it's removed by the exact value
+func (c *Client) decodeQueue(qname string, queSlice []string) ([]InputMsg, []string) {
+	// Unmarshal each redis queue message to input message struct
+	var (
+		queueStruct []InputMsg
+		raws        []string
+	)
+	for _, queue := range queSlice {
+		msg, err := unmarshalMsg(c.codec, queue)
+		if err != nil {
+			// Quarantine unparseable message so it doesn't block the queue
+			c.logger.Errorf("Moving malformed msg of %s queue to %s queue : %v", qname, QueueCorrupt, err)
+			c.quarantineMsg(qname, queue)
+			continue
+		}
+		queueStruct = append(queueStruct, msg)
+		raws = append(raws, queue)
+	}
+	return queueStruct, raws
+}
+
+// quarantineMsg moves the raw message from qName queue to the corrupt queue
+func (c *Client) quarantineMsg(qName string, rawMsg string) {
+	_, err := c.redisCli.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(c.ctx, c.key(qName), 1, rawMsg)
+		pipe.RPush(c.ctx, c.key(QueueCorrupt), rawMsg)
+		return nil
+	})
+	if err != nil {
+		c.logger.Errorf("Error moving malformed msg to %s queue : %v", QueueCorrupt, err)
+	}
+}
+
+// OldestMessageAge returns how long the head message of the queue has been
+// waiting since it's added, e.g for SLA alerts. It's zero for the empty queue
+// or the message stored without EnqueuedAt
+func (c *Client) OldestMessageAge(qName string) (time.Duration, error) {
+	msg, found, err := c.NextMessage(qName)
+	if err != nil || !found || msg.EnqueuedAt.IsZero() {
+		return 0, err
+	}
+	return time.Since(msg.EnqueuedAt), nil
+}
+
+// NextMessage fetches the head message of the queue i.e the next one to be
+// executed, found is false if the queue is empty
+func (c *Client) NextMessage(qName string) (InputMsg, bool, error) {
+	val, err := c.redisCli.LIndex(c.ctx, c.key(qName), 0).Result()
+	if err == redis.Nil {
+		return InputMsg{}, false, nil
+	}
+	if err != nil {
+		return InputMsg{}, false, fmt.Errorf("error fetching %s queue : %w", qName, redisErr(err))
+	}
+	msg, err := unmarshalMsg(c.codec, val)
+	if err != nil {
+		return InputMsg{}, false, err
+	}
+	return msg, true, nil
+}
+
+// PopMessage removes and returns the head message of the queue, e.g for a
+// custom executor in place of RawExecute, found is false if the queue is
+// empty. Malformed message is moved to the corrupt queue
+func (c *Client) PopMessage(qName string) (InputMsg, bool, error) {
+	val, err := c.redisCli.LPop(c.ctx, c.key(qName)).Result()
+	if err == redis.Nil {
+		return InputMsg{}, false, nil
+	}
+	if err != nil {
+		return InputMsg{}, false, fmt.Errorf("error popping %s queue : %w", qName, redisErr(err))
+	}
+	msg, err := unmarshalMsg(c.codec, val)
+	if err != nil {
+		// Message is already removed, keep it for inspection
+		if err := c.redisCli.RPush(c.ctx, c.key(QueueCorrupt), val).Err(); err != nil {
+			c.logger.Errorf("Error moving malformed msg to %s queue : %v", QueueCorrupt, err)
+		}
+		return InputMsg{}, false, err
+	}
+	return msg, true, nil
+}
+
+// PeekQueue fetches up to n messages from the head of the queue without executing them
+func (c *Client) PeekQueue(qName string, n int) ([]InputMsg, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	queSlice, err := c.redisCli.LRange(c.ctx, c.key(qName), 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s queue : %w", qName, redisErr(err))
+	}
+	var queueStruct []InputMsg
+	for _, queue := range queSlice {
+		msg, err := unmarshalMsg(c.codec, queue)
+		if err != nil {
+			c.logger.Errorf("Skipping malformed msg of %s queue : %v", qName, err)
+			continue
+		}
+		queueStruct = append(queueStruct, msg)
+	}
+	return queueStruct, nil
+}
+
+// GetAllDeadMessages fetches messages of all the dead letter queues keyed by status code
+func (c *Client) GetAllDeadMessages() (map[int][]InputMsg, error) {
+	return c.GetAllDeadMessagesOf(c.queueName)
+}
+
+// GetAllDeadMessagesOf fetches messages of the dead letter queues of the qName
+// request queue keyed by status code
+func (c *Client) GetAllDeadMessagesOf(qName string) (map[int][]InputMsg, error) {
+	deadMsgs := make(map[int][]InputMsg)
+	for _, value := range c.deadHTTP {
+		msgs, err := c.GetQueue(c.DeadQueueName(qName, value))
+		if err != nil {
+			return nil, err
+		}
+		deadMsgs[value] = msgs
+	}
+	return deadMsgs, nil
+}
+
+// GetDeadMessagesByCode fetches messages of the dead letter queue of status code
+// it returns error if code isn't one of the dead status codes
+func (c *Client) GetDeadMessagesByCode(code int) ([]InputMsg, error) {
+	return c.GetDeadMessagesByCodeOf(c.queueName, code)
+}
+
+// GetDeadMessagesByCodeOf is GetDeadMessagesByCode for the dead queue of the
+// qName request queue
+func (c *Client) GetDeadMessagesByCodeOf(qName string, code int) ([]InputMsg, error) {
+	if !Find(c.deadHTTP, code) {
+		return nil, fmt.Errorf("%d is not a dead status code", code)
+	}
+	return c.GetQueue(c.DeadQueueName(qName, code))
+}
+
+// GetFailedQueue fetches all messages that exhausted the retries
+func (c *Client) GetFailedQueue() ([]InputMsg, error) {
+	return c.GetQueue(QueueFailed)
+}
+
+// SetQueue marshals the input message struct and save it to redis
+func (c *Client) SetQueue(queName string, msg InputMsg) error {
+	msgInput, err := marshalMsg(c.codec, msg)
+	if err != nil {
+		return err
+	}
+	// Set message to given queue name(key)
+	err = c.redisCli.RPush(c.ctx, c.key(queName), msgInput).Err()
+	if err != nil {
+		return redisErr(err)
+	}
+	return nil
+}
+
+// UpdateMessage replaces the message of qName queue in place, keeping it's
+// position. Message is matched by ID if set, else by name, ID of the message
+// matched by name is kept. It returns ErrMsgNotFound if the message isn't in
+// the queue
+func (c *Client) UpdateMessage(qName string, msg InputMsg) error {
+	match := byName(msg.Name)
+	if msg.ID != "" {
+		match = byID(msg.ID)
+	}
+	existing, rawMsg, err := c.findMsg(qName, match)
+	if err != nil {
+		return err
+	}
+	if msg.ID == "" {
+		msg.ID = existing.ID
+	}
+	msgInput, err := marshalMsg(c.codec, msg)
+	if err != nil {
+		return err
+	}
+	// Message is replaced by it's stored value, as it's position may shift or
+	// it may be removed by other consumers since it's read
+	var inserted *redis.IntCmd
+	_, err = c.redisCli.TxPipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		inserted = pipe.LInsertBefore(c.ctx, c.key(qName), rawMsg, msgInput)
+		pipe.LRem(c.ctx, c.key(qName), 1, rawMsg)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error updating msg %s : %w", msg.Name, redisErr(err))
+	}
+	if inserted.Val() < 0 {
+		return fmt.Errorf("%w in the %s queue : %s", ErrMsgNotFound, qName, msg.Name)
+	}
+	return nil
+}
+
+// Fetch input msg detail, found is false if the message is not in the queue
+func (c *Client) MsgDetail(qName string, msgName string) (InputMsg, bool, error) {
+	msg, _, err := c.findMsg(qName, byName(msgName))
+	return foundMsg(msg, err)
+}
+
+// Fetch input msg detail by message ID, found is false if the message is not
+// in the queue
+func (c *Client) MsgDetailByID(qName string, msgID string) (InputMsg, bool, error) {
+	msg, _, err := c.findMsg(qName, byID(msgID))
+	return foundMsg(msg, err)
+}
+
+// foundMsg converts the ErrMsgNotFound of findMsg to not found
+func foundMsg(msg InputMsg, err error) (InputMsg, bool, error) {
+	if errors.Is(err, ErrMsgNotFound) {
+		return InputMsg{}, false, nil
+	}
+	if err != nil {
+		return InputMsg{}, false, err
+	}
+	return msg, true, nil
+}
+
+// byName matches the message by name
+func byName(msgName string) func(InputMsg) bool {
+	return func(msg InputMsg) bool {
+		return msg.Name == msgName
+	}
+}
+
+// byID matches the message by ID
+func byID(msgID string) func(InputMsg) bool {
+	return func(msg InputMsg) bool {
+		return msg.ID == msgID
+	}
+}
+
+// findMsg returns the first message of the queue that matches along it's raw
+// message as stored, it returns ErrQueueEmpty or ErrMsgNotFound if none matches
+func (c *Client) findMsg(qName string, match func(InputMsg) bool) (InputMsg, string, error) {
+	// fetch all messages available in queue
+	queSlice, err := c.redisCli.LRange(c.ctx, c.key(qName), 0, -1).Result()
+	if err != nil {
+		return InputMsg{}, "", fmt.Errorf("error fetching %s queue : %w", qName, redisErr(err))
+	}
+	msgQueue, raws := c.decodeQueue(qName, queSlice)
+	if len(msgQueue) == 0 {
+		return InputMsg{}, "", fmt.Errorf("%w : %s", ErrQueueEmpty, qName)
+	}
+	for i, msg := range msgQueue {
+		if match(msg) {
+			return msg, raws[i], nil
+		}
+	}
+	return InputMsg{}, "", fmt.Errorf("%w in the %s queue", ErrMsgNotFound, qName)
+}
+
+// redisError wraps the failed redis command error, it matches both the
+// ErrRedisUnavailable and the command error
+type redisError struct {
+	err error
+}
+
+func (e *redisError) Error() string {
+	return ErrRedisUnavailable.Error() + " : " + e.err.Error()
+}
+
+func (e *redisError) Is(target error) bool {
+	return target == ErrRedisUnavailable
+}
+
+func (e *redisError) Unwrap() error {
+	return e.err
+}
+
+// redisErr wraps the failed redis command error as ErrRedisUnavailable, context
+// errors and nil are returned as is
+func redisErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &redisError{err: err}
+}
+
+// msgHash computes sha256 hash of the message request method, url, params,
+// headers, basic auth credentials, body and multipart parts
+func msgHash(msg InputMsg) string {
+	// json marshals the map keys in sorted order
+	reqDetail, _ := json.Marshal(struct {
+		ReqMethod     string
+		Url           string
+		PostParam     url.Values
+		QueryParam    url.Values
+		Headers       http.Header
+		BasicAuthUser string
+		BasicAuthPass string
+		Body          []byte
+		Multipart     []MultipartPart
+	}{msg.ReqMethod, msg.Url, msg.PostParam, msg.QueryParam, msg.Headers,
+		msg.BasicAuthUser, msg.BasicAuthPass, msg.Body, msg.Multipart})
+	hash := sha256.Sum256(reqDetail)
+	return hex.EncodeToString(hash[:])
+}
+
+// NewMsgID generates a random UUID v4 message ID
+func NewMsgID() string {
+	var uuid [16]byte
+	_, err := rand.Read(uuid[:])
+	if err != nil {
+		// Fallback to time based ID, crypto/rand failure is unexpected
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	// Set version 4 and RFC 4122 variant bits
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// Find takes a slice and looks for an element in it. If found it will
+// return bool true else false
+func Find(httpSlice []int, http int) bool {
+	for _, item := range httpSlice {
+		if item == http {
+			return true
+		}
+	}
+	return false
+}
+
+// Marshalmsg marshals the message with JSONCodec
+func Marshalmsg(msg InputMsg) ([]byte, error) {
+	return marshalMsg(JSONCodec{}, msg)
+}
+
+// Unmarshalmsg unmarshals the message with JSONCodec
+func Unmarshalmsg(msg string) (InputMsg, error) {
+	return unmarshalMsg(JSONCodec{}, msg)
+}
+
+// marshalMsg marshals the message with codec
+func marshalMsg(codec Codec, msg InputMsg) ([]byte, error) {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w : %v", ErrMarshal, err)
+	}
+	return data, nil
 }
 
-// Unmarshalmsg
-func Unmarshalmsg(msg string) InputMsg {
+// unmarshalMsg unmarshals the message with codec
+func unmarshalMsg(codec Codec, msg string) (InputMsg, error) {
 	var msgStruct InputMsg
-	err := json.Unmarshal([]byte(msg), &msgStruct)
+	err := codec.Unmarshal([]byte(msg), &msgStruct)
 	if err != nil {
-		log.Fatalf("Error unmarshalling %v", err)
+		return InputMsg{}, fmt.Errorf("%w : %v", ErrMarshal, err)
 	}
-	return msgStruct
+	return msgStruct, nil
 }
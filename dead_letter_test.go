@@ -1,17 +1,31 @@
 package deadletterqueue
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/go-redis/redismock/v8"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -25,13 +39,81 @@ var (
 func MockRedis() {
 	db, mock = redismock.NewClientMock()
 	cli = Client{
-		redisCli:  db,
-		queueName: "ReqQueue",
-		ctx:       context.TODO(),
-		deadHTTP:  []int{400, 429, 502},
+		redisCli:    db,
+		httpClient:  &http.Client{Timeout: DefaultRequestTimeout},
+		queueName:   "ReqQueue",
+		ctx:         context.TODO(),
+		deadHTTP:    []int{400, 429, 502},
+		logger:      stdLogger{},
+		concurrency: 1,
+		codec:       JSONCodec{},
+		respPrefix:  DefaultResponsePrefix,
 	}
 }
 
+func TestNewRedisUnavailable(t *testing.T) {
+	// Nothing listens on the port, New fails at startup
+	client, err := New(ClientParam{RedisAddr: "localhost:1"})
+	assert.NotNil(t, err)
+	assert.Nil(t, client)
+}
+
+func TestPing(t *testing.T) {
+	MockRedis()
+	mock.ExpectPing().SetVal("PONG")
+	assert.Nil(t, cli.Ping())
+
+	mock.ExpectPing().SetErr(errors.New("connection refused"))
+	assert.ErrorIs(t, cli.Ping(), ErrRedisUnavailable)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestClose(t *testing.T) {
+	client := &Client{redisCli: redis.NewClient(&redis.Options{Addr: "localhost:1"}), ctx: context.TODO()}
+	assert.Nil(t, client.Close())
+	// Closed client can't be used anymore
+	_, err := client.QueueLength("ReqQueue")
+	assert.ErrorIs(t, err, redis.ErrClosed)
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+}
+
+func TestClusterClient(t *testing.T) {
+	// Cluster redis client is used when cluster addresses are set
+	rdb := newRedisClient(ClientParam{ClusterAddrs: []string{"localhost:7000", "localhost:7001"}})
+	defer rdb.Close()
+	_, ok := rdb.(*redis.ClusterClient)
+	assert.True(t, ok)
+}
+
+func TestSentinelClient(t *testing.T) {
+	// Failover redis client is used when sentinel params are set
+	rdb := newRedisClient(ClientParam{
+		MasterName:    "mymaster",
+		SentinelAddrs: []string{"localhost:26379"},
+	})
+	defer rdb.Close()
+	client, ok := rdb.(*redis.Client)
+	assert.True(t, ok)
+	assert.Equal(t, "FailoverClient", client.Options().Addr)
+}
+
+func TestRedisDB(t *testing.T) {
+	rdb := newRedisClient(ClientParam{RedisAddr: "localhost:6379", RedisDB: 2})
+	defer rdb.Close()
+	client, ok := rdb.(*redis.Client)
+	assert.True(t, ok)
+	assert.Equal(t, 2, client.Options().DB)
+}
+
+func TestRedisTLS(t *testing.T) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	rdb := newRedisClient(ClientParam{RedisAddr: "redis.example.com:6380", RedisTLS: tlsConfig})
+	defer rdb.Close()
+	client, ok := rdb.(*redis.Client)
+	assert.True(t, ok)
+	assert.Equal(t, tlsConfig, client.Options().TLSConfig)
+}
+
 func TestAddMessage(t *testing.T) {
 	// Initialize the mock redis
 	MockRedis()
@@ -61,12 +143,174 @@ func TestAddMessage(t *testing.T) {
 		Headers:   headers,
 	}
 	// mock to set reqMsg for AddMessage call
-	mock.ExpectRPush("ReqQueue", structToJson(reqMsgOrd)).SetVal(1)
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(reqMsgOrd)).SetVal(1)
 
 	err := cli.AddMessage(reqMsgOrd)
 	assert.Nil(t, err)
 }
 
+func TestAddMessageDedup(t *testing.T) {
+	MockRedis()
+	cli.dedupWindow = time.Minute
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	dedupKey := "ReqQueue:dedup:" + msgHash(reqMsg)
+
+	mock.ExpectSetNX(dedupKey, 1, time.Minute).SetVal(true)
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(reqMsg)).SetVal(1)
+	err := cli.AddMessage(reqMsg)
+	assert.Nil(t, err)
+
+	// Same request added again within the window is refused
+	mock.ExpectSetNX(dedupKey, 1, time.Minute).SetVal(false)
+	err = cli.AddMessage(reqMsg)
+	assert.ErrorIs(t, err, ErrDuplicateMessage)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAddMessageDedupMultipart(t *testing.T) {
+	MockRedis()
+	cli.dedupWindow = time.Minute
+	uploadMsg := func(fileName string, content string) InputMsg {
+		return InputMsg{
+			Name:      "Upload contract note",
+			Url:       "https://api.kite.trade/uploads",
+			ReqMethod: "POST",
+			Multipart: []MultipartPart{{FieldName: "file", FileName: fileName, Content: []byte(content)}},
+		}
+	}
+	firstMsg := uploadMsg("note-1.pdf", "first")
+	secondMsg := uploadMsg("note-2.pdf", "second")
+	// Uploads of different files aren't duplicates
+	assert.NotEqual(t, msgHash(firstMsg), msgHash(secondMsg))
+
+	mock.ExpectSetNX("ReqQueue:dedup:"+msgHash(firstMsg), 1, time.Minute).SetVal(true)
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(firstMsg)).SetVal(1)
+	mock.ExpectSetNX("ReqQueue:dedup:"+msgHash(secondMsg), 1, time.Minute).SetVal(true)
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(secondMsg)).SetVal(1)
+	assert.Nil(t, cli.AddMessage(firstMsg))
+	assert.Nil(t, cli.AddMessage(secondMsg))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Requests with different basic auth users aren't duplicates either
+	userMsg := InputMsg{Name: "Fetch profile", Url: "https://api.kite.trade/user/profile", ReqMethod: "GET", BasicAuthUser: "AB1234"}
+	otherMsg := userMsg
+	otherMsg.BasicAuthUser = "CD5678"
+	assert.NotEqual(t, msgHash(userMsg), msgHash(otherMsg))
+}
+
+func TestAddMessages(t *testing.T) {
+	MockRedis()
+	orderMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	tradeMsg := InputMsg{Name: "Fetch trade book", Url: "https://api.kite.trade/trades", ReqMethod: "GET"}
+	// All the messages are pushed with a single RPush
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(orderMsg), structToJson(tradeMsg)).SetVal(2)
+
+	err := cli.AddMessages([]InputMsg{orderMsg, tradeMsg})
+	assert.Nil(t, err)
+	// Empty batch is a no-op
+	err = cli.AddMessages(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestKeyPrefix(t *testing.T) {
+	MockRedis()
+	cli.keyPrefix = "dlq:myapp:"
+	// Following tests share the client
+	defer func() { cli.keyPrefix = "" }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET"}
+	// Queues and responses are stored under the prefixed keys
+	mock.Regexp().ExpectSet("dlq:myapp:resp:Fetch order book", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("dlq:myapp:429", structToJson(deadLettered(reqMsg, 429, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("dlq:myapp:ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+
+	mock.ExpectLLen("dlq:myapp:429").SetVal(1)
+	length, err := cli.QueueLength("429")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), length)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// prefixCodec tags the JSON with a version prefix
+type prefixCodec struct{}
+
+func (prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	return append([]byte("v1:"), data...), err
+}
+
+func (prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(bytes.TrimPrefix(data, []byte("v1:")), v)
+}
+
+func TestCodec(t *testing.T) {
+	MockRedis()
+	cli.codec = prefixCodec{}
+	// Following tests share the client
+	defer func() { cli.codec = JSONCodec{} }()
+	reqMsg := InputMsg{ID: NewMsgID(), Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET",
+		EnqueuedAt: time.Date(2022, 1, 3, 9, 15, 0, 0, time.UTC)}
+	encoded := append([]byte("v1:"), structToJson(reqMsg)...)
+	mock.ExpectRPush("ReqQueue", encoded).SetVal(1)
+	err := cli.AddMessage(reqMsg)
+	assert.Nil(t, err)
+
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(encoded)})
+	msgs, err := cli.GetQueue("ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{reqMsg}, msgs)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCompress(t *testing.T) {
+	MockRedis()
+	cli.codec = gzipCodec{codec: JSONCodec{}, compress: true}
+	// Following tests share the client
+	defer func() {
+		cli.codec = JSONCodec{}
+	}()
+	reqMsg := InputMsg{ID: NewMsgID(), Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET",
+		EnqueuedAt: time.Date(2022, 1, 3, 9, 15, 0, 0, time.UTC)}
+	compressed, err := cli.codec.Marshal(reqMsg)
+	assert.Nil(t, err)
+	assert.True(t, isCompressed(compressed))
+	mock.ExpectRPush("ReqQueue", compressed).SetVal(1)
+	err = cli.AddMessage(reqMsg)
+	assert.Nil(t, err)
+
+	// Uncompressed message is read as is, it isn't rewritten
+	legacyMsg := InputMsg{ID: NewMsgID(), Name: "Fetch trade book", Url: "https://api.kite.trade/trades", ReqMethod: "GET"}
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(compressed), string(structToJson(legacyMsg))})
+	msgs, err := cli.GetQueue("ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{reqMsg, legacyMsg}, msgs)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Compressed response is read uncompressed
+	record, _ := cli.codec.Marshal(ResponseRecord{StatusCode: 200})
+	mock.ExpectGet("resp:Fetch order book").SetVal(string(record))
+	status, err := cli.MessageStatus("Fetch order book")
+	assert.Nil(t, err)
+	assert.Contains(t, status, `"StatusCode":200`)
+
+	// Compressed message is still read once the compression is turned off
+	cli.codec = gzipCodec{codec: JSONCodec{}}
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(compressed), string(structToJson(legacyMsg))})
+	msgs, err = cli.GetQueue("ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{reqMsg, legacyMsg}, msgs)
+	uncompressed, _ := cli.codec.Marshal(reqMsg)
+	assert.Equal(t, structToJson(reqMsg), uncompressed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
 func TestDeleteReqMsg(t *testing.T) {
 	// Add post params
 	postParam := url.Values{}
@@ -89,7 +333,7 @@ func TestDeleteReqMsg(t *testing.T) {
 	stringSlice := []string{string(structToJson(reqMsgSess))}
 	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
 
-	mock.ExpectLRem("ReqQueue", 0, structToJson(reqMsgSess)).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 0, string(structToJson(reqMsgSess))).SetVal(1)
 
 	err := cli.DeleteReqMsg("Post session token")
 	assert.Nil(t, err)
@@ -99,42 +343,2647 @@ func TestDeleteDeadMsg(t *testing.T) {
 	// Add Get and Set mock for all dead http key
 	stringSlice := []string{string(structToJson(reqMsgOrd))}
 	mock.ExpectLRange("400", 0, -1).SetVal(stringSlice)
-	mock.ExpectLRem("400", 0, structToJson(reqMsgOrd)).SetVal(1)
+	mock.ExpectLRem("400", 0, string(structToJson(reqMsgOrd))).SetVal(1)
 
 	mock.ExpectLRange("429", 0, -1).SetVal(stringSlice)
-	mock.ExpectLRem("429", 0, structToJson(reqMsgOrd)).SetVal(1)
+	mock.ExpectLRem("429", 0, string(structToJson(reqMsgOrd))).SetVal(1)
 
 	mock.ExpectLRange("502", 0, -1).SetVal(stringSlice)
-	mock.ExpectLRem("502", 0, structToJson(reqMsgOrd)).SetVal(1)
+	mock.ExpectLRem("502", 0, string(structToJson(reqMsgOrd))).SetVal(1)
 
 	err := cli.DeleteDeadMsg("Place TCS Order")
 	assert.Nil(t, err)
 }
 
-func TestMessageStatus(t *testing.T) {
-	// Load mock response
-	mockOrders, err := ioutil.ReadFile("./mockdata/orderbook_response.json")
-	if err != nil {
-		t.Errorf("Error while fetching orderbook_response. %v", err)
+func TestMsgDetail(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{ID: NewMsgID(), Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	msg, found, err := cli.MsgDetail("ReqQueue", "Fetch order book")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, reqMsg, msg)
+
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	_, found, err = cli.MsgDetailByID("ReqQueue", NewMsgID())
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// Empty queue is not found as well
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{})
+	_, found, err = cli.MsgDetail("ReqQueue", "Fetch order book")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	mock.ExpectLRange("ReqQueue", 0, -1).SetErr(errors.New("connection refused"))
+	_, found, err = cli.MsgDetail("ReqQueue", "Fetch order book")
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+	assert.False(t, found)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestResponsePrefix(t *testing.T) {
+	MockRedis()
+	cli.respPrefix = "response:"
+	record := ResponseRecord{StatusCode: 200, Body: "ok"}
+	recordJSON, _ := json.Marshal(record)
+	// Response of message named same as the request queue doesn't overwrite it
+	mock.ExpectSet("response:ReqQueue", string(recordJSON), 0).SetVal("OK")
+	cli.MessageResponse("ReqQueue", record)
+
+	mock.ExpectGet("response:ReqQueue").SetVal(string(recordJSON))
+	detail, err := cli.MessageResponseDetail("ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, record, detail)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSentinelErrors(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+
+	// Empty queue matches both ErrQueueEmpty and ErrMsgNotFound
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{})
+	err := cli.DelMsg("ReqQueue", "Fetch order book")
+	assert.ErrorIs(t, err, ErrQueueEmpty)
+	assert.ErrorIs(t, err, ErrMsgNotFound)
+
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	err = cli.DelMsg("ReqQueue", "Fetch trade book")
+	assert.ErrorIs(t, err, ErrMsgNotFound)
+	assert.False(t, errors.Is(err, ErrQueueEmpty))
+
+	mock.ExpectLRange("ReqQueue", 0, -1).SetErr(errors.New("connection refused"))
+	err = cli.DelMsg("ReqQueue", "Fetch order book")
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+
+	// Response not stored yet
+	mock.ExpectGet("resp:Fetch order book").RedisNil()
+	_, err = cli.MessageStatus("Fetch order book")
+	assert.ErrorIs(t, err, ErrMsgNotFound)
+
+	mock.ExpectGet("resp:Fetch order book").SetVal("{")
+	_, err = cli.MessageResponseDetail("Fetch order book")
+	assert.ErrorIs(t, err, ErrMarshal)
+
+	_, err = Unmarshalmsg("{")
+	assert.ErrorIs(t, err, ErrMarshal)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteDeadMsgs(t *testing.T) {
+	MockRedis()
+	orderMsg := string(structToJson(InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}))
+	tradeMsg := string(structToJson(InputMsg{Name: "Fetch trade book", Url: "https://api.kite.trade/trades", ReqMethod: "GET"}))
+	holdingMsg := string(structToJson(InputMsg{Name: "Fetch holdings", Url: "https://api.kite.trade/holdings", ReqMethod: "GET"}))
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{orderMsg})
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{tradeMsg, holdingMsg, orderMsg})
+	mock.ExpectLRange("502", 0, -1).SetVal([]string{})
+	// Only the messages matching the names are removed
+	mock.ExpectLRem("400", 1, orderMsg).SetVal(1)
+	mock.ExpectLRem("429", 1, tradeMsg).SetVal(1)
+	mock.ExpectLRem("429", 1, orderMsg).SetVal(1)
+
+	err := cli.DeleteDeadMsgs([]string{"Fetch order book", "Fetch trade book", "Fetch positions"})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRequeueDeadMessage(t *testing.T) {
+	MockRedis()
+	deadMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+		Retries:   2,
+		FailedAt:  time.Date(2022, 6, 27, 9, 15, 0, 0, time.UTC),
 	}
-	// Mock to fetch request status
-	mock.ExpectGet("Fetch order book").SetVal(string(mockOrders))
-	// Check response status for executed message
-	response, err := cli.MessageStatus("Fetch order book")
-	if err != nil {
-		fmt.Printf("Error %v", err)
+	reqMsg := deadMsg
+	reqMsg.Retries = 0
+	reqMsg.FailedAt = time.Time{}
+
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{string(structToJson(deadMsg))})
+	mock.ExpectEval(moveScript, []string{"429", "ReqQueue"}, string(structToJson(deadMsg)), structToJson(reqMsg)).SetVal(int64(1))
+
+	err := cli.RequeueDeadMessage("Fetch order book")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message not available in any dead queue
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("502", 0, -1).SetVal([]string{})
+	err = cli.RequeueDeadMessage("Fetch order book")
+	assert.NotNil(t, err)
+
+	// Message is returned to the queue it originated from
+	deadMsg.OriginQueue = "PriorityQueue"
+	reqMsg.OriginQueue = "PriorityQueue"
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{string(structToJson(deadMsg))})
+	mock.ExpectEval(moveScript, []string{"400", "PriorityQueue"}, string(structToJson(deadMsg)), structToJson(reqMsg)).SetVal(int64(1))
+	err = cli.RequeueDeadMessage("Fetch order book")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestAttemptCount(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+		Attempts:  []Attempt{{StatusCode: 429}, {StatusCode: 502}},
 	}
-	var mockStruct map[string]interface{}
-	json.Unmarshal([]byte(response), &mockStruct)
-	//assert
-	assert.Equal(t, mockStruct["status"], "success", "Fetch order book request failed.")
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	count, err := cli.AttemptCount("Fetch order book")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	// Message not available in any dead queue
+	for _, queue := range []string{"400", "429", "502", QueueFailed} {
+		mock.ExpectLRange(queue, 0, -1).SetVal([]string{})
+	}
+	_, err = cli.AttemptCount("Fetch order book")
+	assert.ErrorIs(t, err, ErrMsgNotFound)
+	assert.Nil(t, mock.ExpectationsWereMet())
 }
 
-// structToString parses struct to json for redis mock
-func structToJson(msg InputMsg) []byte {
-	jsonMessage, err := json.Marshal(msg)
-	if err != nil {
-		fmt.Printf("%v", err)
+func TestRequeueAllDead(t *testing.T) {
+	MockRedis()
+	orderMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET", Retries: 1}
+	tradeMsg := InputMsg{Name: "Fetch trade book", Url: "https://api.kite.trade/trades", ReqMethod: "GET", Retries: 2}
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{string(structToJson(orderMsg)), string(structToJson(tradeMsg))})
+	for _, msg := range []InputMsg{orderMsg, tradeMsg} {
+		reqMsg := msg
+		reqMsg.Retries = 0
+		mock.ExpectEval(moveScript, []string{"429", "ReqQueue"}, string(structToJson(msg)), structToJson(reqMsg)).SetVal(int64(1))
 	}
-	return jsonMessage
+	mock.ExpectLRange("502", 0, -1).SetVal([]string{})
+
+	moved, err := cli.RequeueAllDead()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, moved)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMoveMessage(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.ExpectLRange(QueueFailed, 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	mock.ExpectEval(moveScript, []string{QueueFailed, "triage"}, string(structToJson(reqMsg)), structToJson(reqMsg)).SetVal(int64(1))
+
+	err := cli.MoveMessage(QueueFailed, "triage", "Fetch order book")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message removed meanwhile by another consumer isn't pushed
+	mock.ExpectLRange(QueueFailed, 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	mock.ExpectEval(moveScript, []string{QueueFailed, "triage"}, string(structToJson(reqMsg)), structToJson(reqMsg)).SetVal(int64(0))
+
+	err = cli.MoveMessage(QueueFailed, "triage", "Fetch order book")
+	assert.True(t, errors.Is(err, ErrMsgNotFound))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Cluster queues may be on different slots, message is pushed post it's removal
+	clusterDB, clusterMock := redismock.NewClusterMock()
+	cli.redisCli = clusterDB
+	clusterMock.ExpectLRange(QueueFailed, 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	clusterMock.ExpectLRem(QueueFailed, 1, string(structToJson(reqMsg))).SetVal(1)
+	clusterMock.ExpectRPush("triage", structToJson(reqMsg)).SetVal(1)
+
+	err = cli.MoveMessage(QueueFailed, "triage", "Fetch order book")
+	assert.Nil(t, err)
+	assert.Nil(t, clusterMock.ExpectationsWereMet())
+}
+
+func TestQueueLength(t *testing.T) {
+	MockRedis()
+	mock.ExpectLLen("ReqQueue").SetVal(3)
+	length, err := cli.ReqQueueLength()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), length)
+
+	// Total length across all dead queues
+	mock.ExpectLLen("400").SetVal(1)
+	mock.ExpectLLen("429").SetVal(0)
+	mock.ExpectLLen("502").SetVal(2)
+	length, err = cli.DeadQueueLength()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), length)
+}
+
+func TestIsQueueEmpty(t *testing.T) {
+	MockRedis()
+	mock.ExpectLLen("ReqQueue").SetVal(0)
+	empty, err := cli.IsQueueEmpty("ReqQueue")
+	assert.Nil(t, err)
+	assert.True(t, empty)
+
+	mock.ExpectLLen("429").SetVal(2)
+	empty, err = cli.IsQueueEmpty("429")
+	assert.Nil(t, err)
+	assert.False(t, empty)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestWaitForEmpty(t *testing.T) {
+	MockRedis()
+	emptyPollInterval = time.Millisecond
+	defer func() { emptyPollInterval = 100 * time.Millisecond }()
+	mock.ExpectLLen("ReqQueue").SetVal(2)
+	mock.ExpectLLen("ReqQueue").SetVal(1)
+	mock.ExpectLLen("ReqQueue").SetVal(0)
+	err := cli.WaitForEmpty("ReqQueue", time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Queue not drained within the timeout
+	emptyPollInterval = time.Hour
+	mock.ExpectLLen("ReqQueue").SetVal(1)
+	err = cli.WaitForEmpty("ReqQueue", 10*time.Millisecond)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueueCancelled(t *testing.T) {
+	MockRedis()
+	ctx, cancel := context.WithCancel(context.Background())
+	cli.ctx = ctx
+	cancel()
+
+	// Cancelled context stops before executing any message, queue is left untouched
+	_, err := cli.ExecuteQueue()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueueFailFast(t *testing.T) {
+	MockRedis()
+	cli.failFast = true
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	firstMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET"}
+	secondMsg := InputMsg{Name: "Fetch trade book", Url: server.URL, ReqMethod: "GET"}
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{string(structToJson(firstMsg)), string(structToJson(secondMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadLettered(firstMsg, 429, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(firstMsg))).SetVal(1)
+
+	// Execution stops at the first dead message, second message stays in the queue
+	processed, err := cli.ExecuteQueue()
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Equal(t, 1, hits)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueueRedisError(t *testing.T) {
+	MockRedis()
+	redisErr := errors.New("connection refused")
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetErr(redisErr)
+
+	_, err := cli.ExecuteQueue()
+	assert.ErrorIs(t, err, redisErr)
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+}
+
+func TestRedisErrorsWrapped(t *testing.T) {
+	MockRedis()
+	connErr := errors.New("connection refused")
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+
+	mock.ExpectLLen("ReqQueue").SetErr(connErr)
+	_, err := cli.QueueLength("ReqQueue")
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+
+	mock.ExpectRPush("ReqQueue", structToJson(reqMsg)).SetErr(connErr)
+	assert.ErrorIs(t, cli.SetQueue("ReqQueue", reqMsg), ErrRedisUnavailable)
+
+	mock.ExpectDel("ReqQueue").SetErr(connErr)
+	assert.ErrorIs(t, cli.ClearQueue("ReqQueue"), ErrRedisUnavailable)
+
+	mock.ExpectLRange("ReqQueue", 0, 1).SetErr(connErr)
+	_, err = cli.PeekQueue("ReqQueue", 2)
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+
+	mock.Regexp().ExpectZRangeByScore("ReqQueue:delayed", &redis.ZRangeBy{Min: "-inf", Max: `^\d+$`}).SetErr(connErr)
+	_, err = cli.ExecuteQueue()
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+
+	mock.Regexp().ExpectZRangeByScore("ReqQueue:delayed", &redis.ZRangeBy{Min: "-inf", Max: `^\d+$`}).SetVal([]string{})
+	mock.ExpectZRange("ReqQueue:priority", 0, -1).SetErr(connErr)
+	_, err = cli.ExecuteQueue()
+	assert.ErrorIs(t, err, ErrRedisUnavailable)
+
+	cli.dedupWindow = time.Minute
+	mock.ExpectSetNX("orders:dedup:"+msgHash(reqMsg), 1, time.Minute).SetErr(connErr)
+	assert.ErrorIs(t, cli.AddMessageTo("orders", reqMsg), ErrRedisUnavailable)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetQueueMalformedMsg(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+	}
+	garbage := "{not a json"
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{garbage, string(structToJson(reqMsg))})
+	// Garbage element is moved to the corrupt queue
+	mock.ExpectTxPipeline()
+	mock.ExpectLRem("ReqQueue", 1, garbage).SetVal(1)
+	mock.ExpectRPush(QueueCorrupt, garbage).SetVal(1)
+	mock.ExpectTxPipelineExec()
+
+	msgs, err := cli.GetQueue("ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{reqMsg}, msgs)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCustomLogger(t *testing.T) {
+	MockRedis()
+	logger := &testLogger{}
+	cli.logger = logger
+
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{})
+	_, err := cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"No messages in ReqQueue queue to execute"}, logger.logs)
+}
+
+func TestPeekQueue(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+	}
+	mock.ExpectLRange("ReqQueue", 0, 1).SetVal([]string{string(structToJson(reqMsg))})
+
+	msgs, err := cli.PeekQueue("ReqQueue", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{reqMsg}, msgs)
+}
+
+func TestUpdateMessage(t *testing.T) {
+	MockRedis()
+	orderMsg := InputMsg{ID: NewMsgID(), Name: "Fetch order book", Url: "https://api.kite.trade/order", ReqMethod: "GET"}
+	tradeMsg := InputMsg{ID: NewMsgID(), Name: "Fetch trades", Url: "https://api.kite.trade/trades", ReqMethod: "GET"}
+	stringSlice := []string{string(structToJson(tradeMsg)), string(structToJson(orderMsg))}
+
+	// Matched by name, existing ID is kept
+	fixedMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	updatedMsg := fixedMsg
+	updatedMsg.ID = orderMsg.ID
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
+	mock.ExpectTxPipeline()
+	mock.ExpectLInsertBefore("ReqQueue", string(structToJson(orderMsg)), structToJson(updatedMsg)).SetVal(3)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(orderMsg))).SetVal(1)
+	mock.ExpectTxPipelineExec()
+	err := cli.UpdateMessage("ReqQueue", fixedMsg)
+	assert.Nil(t, err)
+
+	// Matched by ID
+	updatedTrade := tradeMsg
+	updatedTrade.Url = "https://api.kite.trade/trades?segment=NSE"
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
+	mock.ExpectTxPipeline()
+	mock.ExpectLInsertBefore("ReqQueue", string(structToJson(tradeMsg)), structToJson(updatedTrade)).SetVal(3)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(tradeMsg))).SetVal(1)
+	mock.ExpectTxPipelineExec()
+	err = cli.UpdateMessage("ReqQueue", updatedTrade)
+	assert.Nil(t, err)
+
+	// Message removed by another consumer between the read and the write,
+	// nothing is written
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
+	mock.ExpectTxPipeline()
+	mock.ExpectLInsertBefore("ReqQueue", string(structToJson(tradeMsg)), structToJson(updatedTrade)).SetVal(-1)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(tradeMsg))).SetVal(0)
+	mock.ExpectTxPipelineExec()
+	err = cli.UpdateMessage("ReqQueue", updatedTrade)
+	assert.True(t, errors.Is(err, ErrMsgNotFound))
+
+	// Message not in the queue
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
+	err = cli.UpdateMessage("ReqQueue", InputMsg{Name: "Fetch holdings"})
+	assert.True(t, errors.Is(err, ErrMsgNotFound))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestNextMessage(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.ExpectLIndex("ReqQueue", 0).SetVal(string(structToJson(reqMsg)))
+
+	msg, found, err := cli.NextMessage("ReqQueue")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, reqMsg, msg)
+
+	// Empty queue
+	mock.ExpectLIndex("ReqQueue", 0).RedisNil()
+	_, found, err = cli.NextMessage("ReqQueue")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// Malformed message
+	mock.ExpectLIndex("ReqQueue", 0).SetVal("{")
+	_, found, err = cli.NextMessage("ReqQueue")
+	assert.True(t, errors.Is(err, ErrMarshal))
+	assert.False(t, found)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	MockRedis()
+	cli.maxMsgBytes = 1024
+	smallMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	largeMsg := InputMsg{Name: "Place basket", Url: "https://api.kite.trade/orders", ReqMethod: "POST", Body: bytes.Repeat([]byte("a"), 2048)}
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(smallMsg)).SetVal(1)
+	err := cli.AddMessage(smallMsg)
+	assert.Nil(t, err)
+
+	// Large message is refused before any write
+	err = cli.AddMessage(largeMsg)
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	err = cli.AddMessages([]InputMsg{smallMsg, largeMsg})
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	largeMsg.ExecuteAt = time.Now().Add(time.Hour)
+	err = cli.AddDelayedMessage(largeMsg)
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPopMessage(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.ExpectLPop("ReqQueue").SetVal(string(structToJson(reqMsg)))
+
+	msg, found, err := cli.PopMessage("ReqQueue")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, reqMsg, msg)
+
+	// Empty queue
+	mock.ExpectLPop("ReqQueue").RedisNil()
+	_, found, err = cli.PopMessage("ReqQueue")
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// Malformed message is moved to the corrupt queue
+	mock.ExpectLPop("ReqQueue").SetVal("{")
+	mock.ExpectRPush(QueueCorrupt, "{").SetVal(1)
+	_, found, err = cli.PopMessage("ReqQueue")
+	assert.True(t, errors.Is(err, ErrMarshal))
+	assert.False(t, found)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestOldestMessageAge(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET",
+		EnqueuedAt: time.Now().Add(-time.Minute)}
+	mock.ExpectLIndex("ReqQueue", 0).SetVal(string(structToJson(reqMsg)))
+
+	age, err := cli.OldestMessageAge("ReqQueue")
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, int64(age), int64(time.Minute))
+
+	// Empty queue
+	mock.ExpectLIndex("ReqQueue", 0).RedisNil()
+	age, err = cli.OldestMessageAge("ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), age)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestIterateQueue(t *testing.T) {
+	MockRedis()
+	queuePageSize = 2
+	defer func() { queuePageSize = 100 }()
+
+	orderMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	tradeMsg := InputMsg{Name: "Fetch trades", Url: "https://api.kite.trade/trades", ReqMethod: "GET"}
+	holdingMsg := InputMsg{Name: "Fetch holdings", Url: "https://api.kite.trade/holdings", ReqMethod: "GET"}
+	mock.ExpectLRange("ReqQueue", 0, 1).SetVal([]string{string(structToJson(orderMsg)), string(structToJson(tradeMsg))})
+	mock.ExpectLLen("ReqQueue").SetVal(3)
+	mock.ExpectLRange("ReqQueue", 2, 2).SetVal([]string{string(structToJson(holdingMsg))})
+
+	var msgs []InputMsg
+	err := cli.IterateQueue("ReqQueue", func(msg InputMsg) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{orderMsg, tradeMsg, holdingMsg}, msgs)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Iteration stops on the fn error
+	stopErr := errors.New("stop")
+	mock.ExpectLRange("ReqQueue", 0, 1).SetVal([]string{string(structToJson(orderMsg)), string(structToJson(tradeMsg))})
+	mock.ExpectLLen("ReqQueue").SetVal(3)
+
+	msgs = nil
+	err = cli.IterateQueue("ReqQueue", func(msg InputMsg) error {
+		msgs = append(msgs, msg)
+		return stopErr
+	})
+	assert.Equal(t, stopErr, err)
+	assert.Equal(t, []InputMsg{orderMsg}, msgs)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueuePaged(t *testing.T) {
+	MockRedis()
+	queuePageSize = 2
+	defer func() { queuePageSize = 100 }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	orderMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET"}
+	tradeMsg := InputMsg{Name: "Fetch trades", Url: server.URL + "/trades", ReqMethod: "GET"}
+	holdingMsg := InputMsg{Name: "Fetch holdings", Url: server.URL + "/holdings", ReqMethod: "GET"}
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 1).SetVal([]string{string(structToJson(orderMsg)), string(structToJson(tradeMsg))})
+	mock.ExpectLLen("ReqQueue").SetVal(3)
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(orderMsg))).SetVal(1)
+	mock.Regexp().ExpectSet("resp:Fetch trades", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(tradeMsg))).SetVal(1)
+	// Executed messages are removed, next page starts from the head again
+	mock.ExpectLRange("ReqQueue", 0, 0).SetVal([]string{string(structToJson(holdingMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch holdings", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(holdingMsg))).SetVal(1)
+
+	processed, err := cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Messages left in the queue on dry run are skipped by the next page
+	cli.dryRun = true
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 1).SetVal([]string{string(structToJson(orderMsg)), string(structToJson(tradeMsg))})
+	mock.ExpectLLen("ReqQueue").SetVal(3)
+	mock.Regexp().ExpectSet("resp:Fetch order book", DryRunBody, 0).SetVal("OK")
+	mock.Regexp().ExpectSet("resp:Fetch trades", DryRunBody, 0).SetVal("OK")
+	mock.ExpectLRange("ReqQueue", 2, 2).SetVal([]string{string(structToJson(holdingMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch holdings", DryRunBody, 0).SetVal("OK")
+
+	processed, err = cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueueLegacyMsg(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/quote" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	// Messages stored before the newer fields were added don't match their
+	// re-marshal, they're removed by the stored value
+	orderMsg := `{"Name":"Fetch order book","Url":"` + server.URL + `/orders","ReqMethod":"GET","PostParam":null,"Headers":null}`
+	quoteMsg := `{"Name":"Fetch quote","Url":"` + server.URL + `/quote","ReqMethod":"GET","PostParam":null,"Headers":null}`
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{orderMsg, quoteMsg})
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, orderMsg).SetVal(1)
+	mock.Regexp().ExpectSet("resp:Fetch quote", `"StatusCode":429`, 0).SetVal("OK")
+	deadMsg := deadLettered(InputMsg{Name: "Fetch quote", Url: server.URL + "/quote", ReqMethod: "GET"}, 429, "ReqQueue")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadMsg)).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, quoteMsg).SetVal(1)
+
+	processed, err := cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message gone from the queue meanwhile isn't reported as removed
+	mock.ExpectLRem("ReqQueue", 1, orderMsg).SetVal(0)
+	legacyMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET"}
+	assert.False(t, cli.handleDead(legacyMsg, storedMsg{raw: orderMsg}, "ReqQueue", false, 200, "200 OK"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueueWithLimit(t *testing.T) {
+	MockRedis()
+	queuePageSize = 2
+	defer func() { queuePageSize = 100 }()
+
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	orderMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET"}
+	tradeMsg := InputMsg{Name: "Fetch trades", Url: server.URL + "/trades", ReqMethod: "GET"}
+	holdingMsg := InputMsg{Name: "Fetch holdings", Url: server.URL + "/holdings", ReqMethod: "GET"}
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 1).SetVal([]string{string(structToJson(orderMsg)), string(structToJson(tradeMsg))})
+	mock.ExpectLLen("ReqQueue").SetVal(3)
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(orderMsg))).SetVal(1)
+	// Limit is reached within the page, rest of the queue isn't fetched
+	processed, err := cli.ExecuteQueueWithLimit("ReqQueue", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Equal(t, 1, hits)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Limit past the queue length executes all
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 1).SetVal([]string{string(structToJson(tradeMsg)), string(structToJson(holdingMsg))})
+	mock.ExpectLLen("ReqQueue").SetVal(2)
+	mock.Regexp().ExpectSet("resp:Fetch trades", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(tradeMsg))).SetVal(1)
+	mock.Regexp().ExpectSet("resp:Fetch holdings", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(holdingMsg))).SetVal(1)
+	processed, err = cli.ExecuteQueueWithLimit("ReqQueue", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, processed)
+	assert.Equal(t, 3, hits)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestQueueLock(t *testing.T) {
+	MockRedis()
+	cli.lockTTL = time.Minute
+	// Queue executed by another consumer is skipped
+	mock.Regexp().ExpectSetNX("ReqQueue:lock", `.+`, time.Minute).SetVal(false)
+	_, err := cli.ExecuteQueueName("ReqQueue")
+	assert.True(t, errors.Is(err, ErrQueueLocked))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Lock is released post the execution with it's token
+	var token string
+	mock.Regexp().ExpectSetNX("ReqQueue:lock", `.+`, time.Minute).SetVal(true)
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{})
+	mock.CustomMatch(func(expected, actual []interface{}) error {
+		token = fmt.Sprint(actual[len(actual)-1])
+		expected[len(expected)-1] = actual[len(actual)-1]
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("expected %v, got %v", expected, actual)
+		}
+		return nil
+	}).ExpectEval(unlockScript, []string{"ReqQueue:lock"}, "").SetVal(int64(1))
+	processed, err := cli.ExecuteQueueName("ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, processed)
+	assert.NotEmpty(t, token)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Lock is released on the client context cancellation during the run
+	MockRedis()
+	cli.lockTTL = time.Minute
+	hook := ctxHook{errs: map[string]error{}}
+	db.AddHook(hook)
+	ctx, cancel := context.WithCancel(context.Background())
+	cli.ctx = ctx
+	cli.mutator = func(msg InputMsg) InputMsg {
+		cancel()
+		return msg
+	}
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.Regexp().ExpectSetNX("ReqQueue:lock", `.+`, time.Minute).SetVal(true)
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{string(structToJson(reqMsg))})
+	mock.CustomMatch(func(expected, actual []interface{}) error {
+		expected[len(expected)-1] = actual[len(actual)-1]
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("expected %v, got %v", expected, actual)
+		}
+		return nil
+	}).ExpectEval(unlockScript, []string{"ReqQueue:lock"}, "").SetVal(int64(1))
+	_, err = cli.ExecuteQueueName("ReqQueue")
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Contains(t, hook.errs, "eval")
+	assert.Nil(t, hook.errs["eval"])
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Lock is refreshed with it's token till it's released
+	MockRedis()
+	cli.lockTTL = 300 * time.Millisecond
+	refreshed := make(chan struct{})
+	mock.Regexp().ExpectSetNX("ReqQueue:lock", `.+`, 300*time.Millisecond).SetVal(true)
+	mock.CustomMatch(func(expected, actual []interface{}) error {
+		expected[len(expected)-2] = actual[len(actual)-2]
+		defer close(refreshed)
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("expected %v, got %v", expected, actual)
+		}
+		return nil
+	}).ExpectEval(refreshLockScript, []string{"ReqQueue:lock"}, "", int64(300)).SetVal(int64(1))
+	mock.CustomMatch(func(expected, actual []interface{}) error {
+		expected[len(expected)-1] = actual[len(actual)-1]
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("expected %v, got %v", expected, actual)
+		}
+		return nil
+	}).ExpectEval(unlockScript, []string{"ReqQueue:lock"}, "").SetVal(int64(1))
+	unlock, err := cli.lockQueue("ReqQueue")
+	assert.Nil(t, err)
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("lock isn't refreshed")
+	}
+	unlock()
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// ctxHook records the context error of the redis commands as they're sent
+type ctxHook struct {
+	errs map[string]error
+}
+
+func (h ctxHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	h.errs[cmd.Name()] = ctx.Err()
+	return ctx, nil
+}
+
+func (h ctxHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h ctxHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h ctxHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestWithContext(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(reqMsg)).SetVal(1)
+	err := cli.WithContext(context.Background()).AddMessage(reqMsg)
+	assert.Nil(t, err)
+
+	// Cancelled call context stops the execution, client context is kept
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cli.WithContext(ctx).ExecuteQueue()
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Nil(t, cli.ctx.Err())
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Call deadline applies to the HTTP request, message stays in the queue
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = cli.WithContext(ctx).RawExecute(InputMsg{Name: "Fetch trades", Url: server.URL, ReqMethod: "GET"}, "ReqQueue")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteReqMsgByID(t *testing.T) {
+	MockRedis()
+	// Two messages share the same name, only the one with ID is removed
+	firstMsg := InputMsg{ID: NewMsgID(), Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	secondMsg := firstMsg
+	secondMsg.ID = NewMsgID()
+	assert.NotEqual(t, firstMsg.ID, secondMsg.ID)
+
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(structToJson(firstMsg)), string(structToJson(secondMsg))})
+	mock.ExpectLRem("ReqQueue", 0, string(structToJson(secondMsg))).SetVal(1)
+
+	err := cli.DeleteReqMsgByID(secondMsg.ID)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestClearAllQueues(t *testing.T) {
+	MockRedis()
+	for _, queue := range []string{"ReqQueue", "ReqQueue:delayed", "ReqQueue:priority", QueueFailed, QueueCorrupt, "400", "429", "502"} {
+		mock.ExpectDel(queue).SetVal(1)
+	}
+
+	err := cli.ClearAllQueues()
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestStats(t *testing.T) {
+	MockRedis()
+	mock.ExpectLLen("ReqQueue").SetVal(5)
+	mock.ExpectLLen("400").SetVal(0)
+	mock.ExpectLLen("429").SetVal(3)
+	mock.ExpectLLen("502").SetVal(1)
+	mock.ExpectLLen(QueueFailed).SetVal(2)
+
+	stats, err := cli.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, QueueStats{
+		ReqQueue:   5,
+		DeadQueues: map[int]int64{400: 0, 429: 3, 502: 1},
+		Failed:     2,
+	}, stats)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExportImport(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{ID: NewMsgID(), Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	deadMsg := deadLettered(InputMsg{ID: NewMsgID(), Name: "Fetch trades", Url: "https://api.kite.trade/trades", ReqMethod: "GET"}, 429, "ReqQueue")
+	delayedMsg := InputMsg{ID: NewMsgID(), Name: "Fetch holdings", Url: "https://api.kite.trade/portfolio/holdings", ReqMethod: "GET",
+		ExecuteAt: time.Date(2022, 1, 3, 9, 15, 0, 0, time.UTC)}
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{string(structToJson(deadMsg))})
+	mock.ExpectLRange("502", 0, -1).SetVal([]string{})
+	mock.ExpectLRange(QueueFailed, 0, -1).SetVal([]string{})
+	mock.ExpectZRange("ReqQueue:delayed", 0, -1).SetVal([]string{string(structToJson(delayedMsg))})
+	mock.ExpectZRange("ReqQueue:priority", 0, -1).SetVal([]string{})
+
+	data, err := cli.Export()
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	var snapshot QueueSnapshot
+	assert.Nil(t, json.Unmarshal(data, &snapshot))
+	assert.Equal(t, []InputMsg{reqMsg}, snapshot.ReqQueue)
+	assert.Equal(t, []InputMsg{deadMsg}, snapshot.DeadQueues[429])
+	assert.Empty(t, snapshot.DeadQueues[400])
+	assert.Empty(t, snapshot.Failed)
+	assert.Equal(t, []InputMsg{delayedMsg}, snapshot.Delayed)
+
+	// Restored to the same queues, delayed message scored by ExecuteAt
+	mock.ExpectRPush("ReqQueue", structToJson(reqMsg)).SetVal(1)
+	mock.ExpectRPush("429", structToJson(deadMsg)).SetVal(1)
+	mock.ExpectZAdd("ReqQueue:delayed", &redis.Z{
+		Score:  float64(delayedMsg.ExecuteAt.UnixNano() / int64(time.Millisecond)),
+		Member: structToJson(delayedMsg),
+	}).SetVal(1)
+
+	err = cli.Import(data)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Malformed document
+	err = cli.Import([]byte("{"))
+	assert.True(t, errors.Is(err, ErrMarshal))
+}
+
+func TestClearQueuesByPattern(t *testing.T) {
+	MockRedis()
+	cli.keyPrefix = "dlq:"
+	// Following tests share the client
+	defer func() { cli.keyPrefix = "" }()
+	// Keys are scanned and deleted in batches till the cursor is back to 0
+	mock.ExpectScan(0, "dlq:tenant1:*", 100).SetVal([]string{"dlq:tenant1:ReqQueue", "dlq:tenant1:429"}, 7)
+	mock.ExpectDel("dlq:tenant1:ReqQueue").SetVal(1)
+	mock.ExpectDel("dlq:tenant1:429").SetVal(1)
+	mock.ExpectScan(7, "dlq:tenant1:*", 100).SetVal([]string{"dlq:tenant1:failed"}, 0)
+	mock.ExpectDel("dlq:tenant1:failed").SetVal(1)
+
+	removed, err := cli.ClearQueuesByPattern("tenant1:*")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, removed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestGetAllDeadMessages(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.ExpectLRange("400", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+	mock.ExpectLRange("502", 0, -1).SetVal([]string{})
+
+	deadMsgs, err := cli.GetAllDeadMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, map[int][]InputMsg{400: nil, 429: {reqMsg}, 502: nil}, deadMsgs)
+}
+
+func TestGetDeadMessagesByCode(t *testing.T) {
+	MockRedis()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	mock.ExpectLRange("429", 0, -1).SetVal([]string{string(structToJson(reqMsg))})
+
+	deadMsgs, err := cli.GetDeadMessagesByCode(429)
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{reqMsg}, deadMsgs)
+
+	// Status code outside DeadHTTP has no dead queue
+	_, err = cli.GetDeadMessagesByCode(404)
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMessageStatus(t *testing.T) {
+	// Load mock response
+	mockOrders, err := ioutil.ReadFile("./mockdata/orderbook_response.json")
+	if err != nil {
+		t.Errorf("Error while fetching orderbook_response. %v", err)
+	}
+	// Mock to fetch request status
+	mock.ExpectGet("resp:Fetch order book").SetVal(string(mockOrders))
+	// Check response status for executed message
+	response, err := cli.MessageStatus("Fetch order book")
+	if err != nil {
+		fmt.Printf("Error %v", err)
+	}
+	var mockStruct map[string]interface{}
+	json.Unmarshal([]byte(response), &mockStruct)
+	//assert
+	assert.Equal(t, mockStruct["status"], "success", "Fetch order book request failed.")
+}
+
+func TestBackoffDelay(t *testing.T) {
+	MockRedis()
+	cli.backoffBase = time.Second
+	cli.backoffMax = 10 * time.Second
+
+	assert.Equal(t, time.Second, cli.backoffDelay(0))
+	assert.Equal(t, 4*time.Second, cli.backoffDelay(2))
+	assert.Equal(t, 10*time.Second, cli.backoffDelay(5))
+	assert.Equal(t, 10*time.Second, cli.backoffDelay(100))
+
+	// Message failed just now is still in backoff
+	assert.False(t, cli.retryEligible(InputMsg{FailedAt: time.Now()}))
+	assert.True(t, cli.retryEligible(InputMsg{FailedAt: time.Now().Add(-2 * time.Second)}))
+}
+
+func TestBackoffJitter(t *testing.T) {
+	MockRedis()
+	cli.backoffBase = time.Minute
+	cli.jitter = true
+
+	failedAt := time.Now()
+	spread := map[time.Duration]bool{}
+	for i := 0; i < 10; i++ {
+		msg := InputMsg{ID: NewMsgID(), Retries: 1, FailedAt: failedAt}
+		delay := cli.retryDelay(msg)
+		// Jittered delay is within the backoff and same across the runs
+		assert.True(t, delay >= 0 && delay <= 2*time.Minute)
+		assert.Equal(t, delay, cli.retryDelay(msg))
+		spread[delay] = true
+	}
+	// Messages failed together are spread out
+	assert.Greater(t, len(spread), 1)
+}
+
+func TestExecuteDeadQueueBackoff(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{429}
+	cli.backoffBase = time.Minute
+
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+		Retries:   1,
+		FailedAt:  time.Now(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	eligibleMsg := reqMsg
+	eligibleMsg.Name = "Fetch positions"
+	eligibleMsg.Url = server.URL
+	eligibleMsg.FailedAt = time.Now().Add(-time.Hour)
+	// Message in backoff is left in place instead of executed, the
+	// eligible message past it is executed
+	mock.ExpectLRange("429", 0, 99).SetVal([]string{string(structToJson(reqMsg)), string(structToJson(eligibleMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch positions", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("429", 1, string(structToJson(eligibleMsg))).SetVal(1)
+
+	processed, err := cli.ExecuteDeadQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeadMessageMaxAge(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{429}
+	cli.deadMaxAge = 24 * time.Hour
+	var expired []string
+	cli.onFailure = func(msg InputMsg, attempts []Attempt) {
+		expired = append(expired, msg.Name)
+	}
+
+	// First attempt is older than the max age though the last one is recent
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+		Retries:   3,
+		FailedAt:  time.Now(),
+		Attempts: []Attempt{
+			{Timestamp: time.Now().Add(-48 * time.Hour), StatusCode: 429},
+			{Timestamp: time.Now(), StatusCode: 429},
+		},
+	}
+	mock.ExpectLRange("429", 0, 99).SetVal([]string{string(structToJson(reqMsg))})
+	mock.ExpectEval(moveScript, []string{"429", QueueFailed}, string(structToJson(reqMsg)), structToJson(reqMsg)).SetVal(int64(1))
+
+	processed, err := cli.ExecuteDeadQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, processed)
+	assert.Equal(t, []string{"Fetch order book"}, expired)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRawExecuteNetworkDead(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{StatusNetworkError, 429}
+	// Closed test server to simulate an unreachable upstream
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	reqMsg := InputMsg{
+		Name:      "Unreachable upstream",
+		Url:       server.URL,
+		ReqMethod: "GET",
+	}
+	// Failed request is moved to the network dead queue
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("0", structToJson(deadLettered(reqMsg, StatusNetworkError, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueueNetworkDead(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{StatusNetworkError, 429}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	slowMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/slow", ReqMethod: "GET", Timeout: 20 * time.Millisecond}
+	healthyMsg := InputMsg{Name: "Fetch positions", Url: server.URL + "/positions", ReqMethod: "GET"}
+	// Timed out message is dead lettered and the run goes on to the next one
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{string(structToJson(slowMsg)), string(structToJson(healthyMsg))})
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("0", structToJson(deadLettered(slowMsg, StatusNetworkError, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(slowMsg))).SetVal(1)
+	mock.Regexp().ExpectSet("resp:Fetch positions", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(healthyMsg))).SetVal(1)
+
+	processed, err := cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// FailFast stops at the dead lettered message
+	cli.failFast = true
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{string(structToJson(slowMsg)), string(structToJson(healthyMsg))})
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("0", structToJson(deadLettered(slowMsg, StatusNetworkError, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(slowMsg))).SetVal(1)
+
+	processed, err = cli.ExecuteQueue()
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 1, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestOnResult(t *testing.T) {
+	MockRedis()
+	var gotMsg InputMsg
+	var gotRes *http.Response
+	var gotErr error
+	cli.onResult = func(msg InputMsg, res *http.Response, err error) {
+		gotMsg, gotRes, gotErr = msg, res, err
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET"}
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":502`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("502", structToJson(deadLettered(reqMsg, 502, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, reqMsg, gotMsg)
+	assert.Equal(t, http.StatusBadGateway, gotRes.StatusCode)
+	assert.Nil(t, gotErr)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestOnSuccess(t *testing.T) {
+	MockRedis()
+	var succeeded []string
+	cli.onSuccess = func(msg InputMsg, res *http.Response) {
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		succeeded = append(succeeded, msg.Name)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/quote" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	orderMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET"}
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(orderMsg)).SetVal(1)
+	err := cli.RawExecute(orderMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Fetch order book"}, succeeded)
+
+	// Succeeded message left in the queue isn't reported
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(orderMsg)).SetErr(errors.New("connection reset"))
+	cli.RawExecute(orderMsg, "ReqQueue")
+	assert.Len(t, succeeded, 1)
+
+	// Dead message isn't reported
+	quoteMsg := InputMsg{Name: "Fetch quote", Url: server.URL + "/quote", ReqMethod: "GET"}
+	mock.Regexp().ExpectSet("resp:Fetch quote", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadLettered(quoteMsg, 429, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(quoteMsg)).SetVal(1)
+	err = cli.RawExecute(quoteMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Len(t, succeeded, 1)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestIsDead(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = append(cli.deadHTTP, StatusCustomDead)
+	// Response with error body is dead irrespective of the status code
+	cli.isDead = func(res *http.Response, body []byte) bool {
+		return bytes.Contains(body, []byte(`"status":"error"`))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"error","error_type":"InputException"}`))
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Place TCS Order", Url: server.URL, ReqMethod: "GET"}
+	mock.Regexp().ExpectSet("resp:Place TCS Order", `"StatusCode":200`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("1", structToJson(deadLettered(reqMsg, 200, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRawExecuteJSONBody(t *testing.T) {
+	MockRedis()
+	jsonBody := []byte(`{"exchange":"NSE","tradingsymbol":"TCS"}`)
+	// Test server echoes back the received body and content-type
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, jsonBody, body)
+		assert.Equal(t, "application/json", r.Header.Get("content-type"))
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	var headers http.Header = map[string][]string{}
+	headers.Add("content-type", "application/json")
+	reqMsg := InputMsg{
+		Name:      "Place JSON order",
+		Url:       server.URL,
+		ReqMethod: "POST",
+		Headers:   headers,
+		Body:      jsonBody,
+	}
+	mock.Regexp().ExpectSet("resp:Place JSON order", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	MockRedis()
+	cli.defHeaders = http.Header{}
+	cli.defHeaders.Add("x-kite-version", "3")
+	cli.defHeaders.Add("authorization", "token api_key:default_token")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "3", r.Header.Get("x-kite-version"))
+		// Message header takes precedence
+		assert.Equal(t, []string{"token api_key:access_token"}, r.Header.Values("authorization"))
+	}))
+	defer server.Close()
+
+	var headers http.Header = map[string][]string{}
+	headers.Add("authorization", "token api_key:access_token")
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET", Headers: headers}
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRawExecuteBasicAuth(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "api_key", user)
+		assert.Equal(t, "secret", pass)
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	// Basic auth replaces the Authorization header
+	var headers http.Header = map[string][]string{}
+	headers.Add("authorization", "token api_key:access_token")
+	reqMsg := InputMsg{
+		Name:          "Fetch order book",
+		Url:           server.URL,
+		ReqMethod:     "GET",
+		Headers:       headers,
+		BasicAuthUser: "api_key",
+		BasicAuthPass: "secret",
+	}
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRawExecuteMultipart(t *testing.T) {
+	MockRedis()
+	csv := []byte("symbol,quantity\nTCS,2\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseMultipartForm(1<<20))
+		assert.Equal(t, "basket", r.FormValue("name"))
+		file, fileHeader, err := r.FormFile("file")
+		assert.Nil(t, err)
+		content, _ := ioutil.ReadAll(file)
+		assert.Equal(t, csv, content)
+		assert.Equal(t, "orders.csv", fileHeader.Filename)
+		assert.Equal(t, "text/csv", fileHeader.Header.Get("Content-Type"))
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	// Multipart content-type with the boundary replaces the one in headers
+	var headers http.Header = map[string][]string{}
+	headers.Add("content-type", "application/json")
+	reqMsg := InputMsg{
+		Name:      "Upload basket",
+		Url:       server.URL,
+		ReqMethod: "POST",
+		Headers:   headers,
+		Multipart: []MultipartPart{
+			{FieldName: "name", Content: []byte("basket")},
+			{FieldName: "file", FileName: "orders.csv", ContentType: "text/csv", Content: csv},
+		},
+	}
+	mock.Regexp().ExpectSet("resp:Upload basket", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRawExecuteMethodBody(t *testing.T) {
+	MockRedis()
+	postParam := url.Values{}
+	postParam.Add("quantity", "2")
+	// Test server records the received body for each method
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies[r.Method] = string(body)
+	}))
+	defer server.Close()
+
+	for _, method := range []string{"PATCH", "DELETE", "GET"} {
+		reqMsg := InputMsg{Name: "Modify order", Url: server.URL, ReqMethod: method, PostParam: postParam}
+		mock.Regexp().ExpectSet("resp:Modify order", `"StatusCode":200`, 0).SetVal("OK")
+		mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+		err := cli.RawExecute(reqMsg, "ReqQueue")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, map[string]string{"PATCH": "quantity=2", "DELETE": "quantity=2", "GET": ""}, bodies)
+}
+
+func TestPostParamContentType(t *testing.T) {
+	MockRedis()
+	postParam := url.Values{}
+	postParam.Add("quantity", "2")
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	// Form content type is set by default
+	reqMsg := InputMsg{Name: "Modify order", Url: server.URL, ReqMethod: "PUT", PostParam: postParam}
+	mock.Regexp().ExpectSet("resp:Modify order", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, "application/x-www-form-urlencoded", contentType)
+
+	// Explicit content type is kept
+	reqMsg.Headers = http.Header{"Content-Type": []string{"application/x-www-form-urlencoded; charset=utf-8"}}
+	mock.Regexp().ExpectSet("resp:Modify order", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err = cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, "application/x-www-form-urlencoded; charset=utf-8", contentType)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCacheSuccesses(t *testing.T) {
+	MockRedis()
+	cli.cacheOK = true
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{ID: NewMsgID(), Name: "Place TCS Order", Url: server.URL, ReqMethod: "POST"}
+	// Succeeded message is removed without the request
+	record, _ := json.Marshal(ResponseRecord{StatusCode: 200})
+	mock.ExpectGet("resp:" + reqMsg.ID).SetVal(string(record))
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, hits)
+
+	// Message without stored response is executed
+	mock.ExpectGet("resp:" + reqMsg.ID).RedisNil()
+	mock.Regexp().ExpectSet("resp:Place TCS Order", `"StatusCode":200`, 0).SetVal("OK")
+	mock.Regexp().ExpectSet("resp:"+reqMsg.ID, `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err = cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, hits)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMsgDeadHTTP(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{StatusCustomDead, 429}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	// 404 is retried for the message only, it's outside client DeadHTTP
+	reqMsg := InputMsg{Name: "Fetch order", Url: server.URL, ReqMethod: "GET", DeadHTTP: []int{404}}
+	mock.Regexp().ExpectSet("resp:Fetch order", `"StatusCode":404`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("1", structToJson(deadLettered(reqMsg, 404, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+
+	// Message without override follows client DeadHTTP
+	reqMsg.DeadHTTP = nil
+	mock.Regexp().ExpectSet("resp:Fetch order", `"StatusCode":404`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err = cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRequestMutator(t *testing.T) {
+	MockRedis()
+	cli.mutator = func(msg InputMsg) InputMsg {
+		msg.Headers.Set("authorization", "token api_key:fresh_token")
+		msg.Multipart[0].Content[0] = 'F'
+		msg.DeadHTTP[0] = 500
+		return msg
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token api_key:fresh_token", r.Header.Get("authorization"))
+		assert.Equal(t, "Fresh", r.FormValue("note"))
+	}))
+	defer server.Close()
+
+	var headers http.Header = map[string][]string{}
+	headers.Add("authorization", "token api_key:stale_token")
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "POST", Headers: headers,
+		Multipart: []MultipartPart{{FieldName: "note", Content: []byte("fresh")}}, DeadHTTP: []int{429}}
+	// Stored message is removed as is
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Equal(t, "token api_key:stale_token", reqMsg.Headers.Get("authorization"))
+	assert.Equal(t, "fresh", string(reqMsg.Multipart[0].Content))
+	assert.Equal(t, []int{429}, reqMsg.DeadHTTP)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSignRequest(t *testing.T) {
+	MockRedis()
+	secret := []byte("api_secret")
+	sign := func(method, path string, body []byte) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(method + path))
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	cli.signRequest = func(req *http.Request) error {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		data, _ := ioutil.ReadAll(body)
+		req.Header.Set("X-Signature", sign(req.Method, req.URL.Path, data))
+		return nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, sign(r.Method, r.URL.Path, body), r.Header.Get("X-Signature"))
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Place JSON order", Url: server.URL + "/orders", ReqMethod: "POST", Body: []byte(`{"quantity":2}`)}
+	mock.Regexp().ExpectSet("resp:Place JSON order", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message isn't sent and stays in the queue if signing fails
+	signErr := errors.New("signing key unavailable")
+	cli.signRequest = func(req *http.Request) error { return signErr }
+	err = cli.RawExecute(reqMsg, "ReqQueue")
+	assert.True(t, errors.Is(err, signErr))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSkipResponseStore(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{ID: NewMsgID(), Name: "Health check", Url: server.URL, ReqMethod: "HEAD", SkipResponseStore: true}
+	// Only the executed message is removed, no response is stored
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestBinaryResponse(t *testing.T) {
+	MockRedis()
+	jpeg := []byte{0xff, 0xd8, 0xff}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpeg)
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Fetch chart", Url: server.URL, ReqMethod: "GET"}
+	// Binary body is stored as base64 bytes along with the content type
+	mock.Regexp().ExpectSet("resp:Fetch chart", `"Body":"".*"RawBody":"/9j/","ContentType":"image/jpeg"`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+
+	record, _ := json.Marshal(ResponseRecord{StatusCode: 200, RawBody: jpeg, ContentType: "image/jpeg"})
+	mock.ExpectGet("resp:Fetch chart").SetVal(string(record))
+	body, contentType, err := cli.MessageResponseBytes("Fetch chart")
+	assert.Nil(t, err)
+	assert.Equal(t, jpeg, body)
+	assert.Equal(t, "image/jpeg", contentType)
+
+	// Text body is returned as bytes
+	record, _ = json.Marshal(ResponseRecord{StatusCode: 200, Body: `{"status":"success"}`, ContentType: "application/json"})
+	mock.ExpectGet("resp:Fetch order book").SetVal(string(record))
+	body, contentType, err = cli.MessageResponseBytes("Fetch order book")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`{"status":"success"}`), body)
+	assert.Equal(t, "application/json", contentType)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	MockRedis()
+	cli.maxResBytes = 18
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET"}
+	// Body is cut at the limit and marked truncated
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"Body":"{\\"status\\":\\"success",.*"Truncated":true`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDryRun(t *testing.T) {
+	MockRedis()
+	cli.dryRun = true
+	logger := &testLogger{}
+	cli.logger = logger
+	// Request must not reach the server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Dry run sent %s request", r.Method)
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Place JSON order", Url: server.URL, ReqMethod: "POST", Body: []byte(`{"quantity":1}`)}
+	// Only the synthetic response is stored, message is not removed
+	mock.Regexp().ExpectSet("resp:Place JSON order", `"Body":"dry run"`, 0).SetVal("OK")
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Contains(t, logger.logs[0], `POST `+server.URL)
+	assert.Contains(t, logger.logs[0], `{"quantity":1}`)
+}
+
+func TestExecuteMessage(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/quote" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	orderMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET"}
+	quoteMsg := InputMsg{Name: "Fetch quote", Url: server.URL + "/quote", ReqMethod: "GET"}
+	stringSlice := []string{string(structToJson(quoteMsg)), string(structToJson(orderMsg))}
+
+	// Only the named message is executed and removed
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(orderMsg))).SetVal(1)
+
+	result, err := cli.ExecuteMessage("ReqQueue", "Fetch order book")
+	assert.Nil(t, err)
+	assert.Equal(t, ExecResult{Name: "Fetch order book", StatusCode: 200, Success: true}, result)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Failed message is dead lettered
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
+	mock.Regexp().ExpectSet("resp:Fetch quote", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadLettered(quoteMsg, 429, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(quoteMsg))).SetVal(1)
+
+	result, err = cli.ExecuteMessage("ReqQueue", "Fetch quote")
+	assert.Nil(t, err)
+	assert.Equal(t, ExecResult{Name: "Fetch quote", StatusCode: 429}, result)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message not in the queue
+	MockRedis()
+	mock.ExpectLRange("ReqQueue", 0, -1).SetVal(stringSlice)
+
+	_, err = cli.ExecuteMessage("ReqQueue", "Fetch holdings")
+	assert.True(t, errors.Is(err, ErrMsgNotFound))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMessageTimeout(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	// Message timeout longer than the client timeout
+	cli.httpClient = &http.Client{Timeout: 50 * time.Millisecond}
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET", Timeout: 2 * time.Second}
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message timeout shorter than the client timeout, message stays in the queue
+	cli.httpClient = &http.Client{Timeout: 2 * time.Second}
+	reqMsg.Timeout = 20 * time.Millisecond
+
+	err = cli.RawExecute(reqMsg, "ReqQueue")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRedactHeaders(t *testing.T) {
+	MockRedis()
+	cli.dryRun = true
+	cli.redact = []string{"Authorization", "cookie"}
+	logger := &testLogger{}
+	cli.logger = logger
+
+	headers := http.Header{}
+	headers.Set("Authorization", "token api_key:access_token")
+	headers.Set("Cookie", "session=secret")
+	headers.Set("X-Kite-Version", "3")
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET", Headers: headers}
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"Body":"dry run"`, 0).SetVal("OK")
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.NotContains(t, logger.logs[0], "access_token")
+	assert.NotContains(t, logger.logs[0], "secret")
+	assert.Contains(t, logger.logs[0], "Authorization:[***]")
+	assert.Contains(t, logger.logs[0], "X-Kite-Version:[3]")
+	// Message headers are left as is
+	assert.Equal(t, "token api_key:access_token", reqMsg.Headers.Get("Authorization"))
+}
+
+func TestMergeQuery(t *testing.T) {
+	queryParam := url.Values{}
+	queryParam.Add("i", "NSE:INFY")
+
+	reqURL, err := mergeQuery("https://api.kite.trade/quote", queryParam)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.kite.trade/quote?i=NSE%3AINFY", reqURL)
+
+	// Existing query string is merged, not overwritten
+	reqURL, err = mergeQuery("https://api.kite.trade/quote?i=NSE:TCS", queryParam)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.kite.trade/quote?i=NSE%3ATCS&i=NSE%3AINFY", reqURL)
+}
+
+func TestRateLimiter(t *testing.T) {
+	// No limit without the rate
+	assert.Nil(t, newRateLimiter(0))
+	assert.Nil(t, newRateLimiter(0).wait(context.TODO()))
+
+	limiter := newRateLimiter(50)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, limiter.wait(context.TODO()))
+	}
+	// First request is immediate, rest are paced 20ms apart
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(40*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	assert.ErrorIs(t, limiter.wait(ctx), context.Canceled)
+}
+
+func TestExecuteQueueConcurrentPush(t *testing.T) {
+	MockRedis()
+	newMsg := InputMsg{
+		Name:      "Fetch positions",
+		Url:       "https://api.kite.trade/portfolio/positions",
+		ReqMethod: "GET",
+	}
+	// Another producer pushes a new message while the request is in-flight
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := cli.AddMessage(newMsg)
+		assert.Nil(t, err)
+		w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       server.URL,
+		ReqMethod: "GET",
+	}
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{string(structToJson(reqMsg))})
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(newMsg)).SetVal(2)
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	// Only the executed message is removed, the new message stays in the queue
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(reqMsg))).SetVal(1)
+
+	_, err := cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestStartRetryLoop(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{429}
+	mock.ExpectLRange("429", 0, 99).SetVal([]string{})
+
+	stop := cli.StartRetryLoop(10 * time.Millisecond)
+	// Wait for the first run
+	for i := 0; i < 100 && mock.ExpectationsWereMet() != nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+	// Stop is safe to call again
+	stop()
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Loop exits on client context cancellation
+	ctx, cancel := context.WithCancel(context.TODO())
+	cli.ctx = ctx
+	stop = cli.StartRetryLoop(time.Hour)
+	cancel()
+	stop()
+
+	// Invalid interval doesn't start the loop
+	cli.ctx = context.TODO()
+	stop = cli.StartRetryLoop(0)
+	stop()
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteDeadQueueByCode(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	// Only the 502 dead queue is executed
+	reqMsg := deadLettered(InputMsg{Name: "Fetch quote", Url: server.URL, ReqMethod: "GET"}, 502, "ReqQueue")
+	mock.ExpectLRange("502", 0, 99).SetVal([]string{string(structToJson(reqMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch quote", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("502", 1, string(structToJson(reqMsg))).SetVal(1)
+
+	processed, err := cli.ExecuteDeadQueueByCode(502)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Code outside the dead status codes
+	_, err = cli.ExecuteDeadQueueByCode(503)
+	assert.NotNil(t, err)
+}
+
+func TestDrainDeadQueue(t *testing.T) {
+	MockRedis()
+	// Test server recovers for orders, still rate limits quotes
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/quote" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	orderMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET"}
+	quoteMsg := InputMsg{Name: "Fetch quote", Url: server.URL + "/quote", ReqMethod: "GET"}
+	retriedMsg := quoteMsg
+	retriedMsg.Retries = 1
+
+	mock.ExpectLRange("400", 0, 99).SetVal([]string{string(structToJson(orderMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("400", 1, string(structToJson(orderMsg))).SetVal(1)
+	mock.ExpectLRange("429", 0, 99).SetVal([]string{string(structToJson(quoteMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch quote", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectEval(moveScript, []string{"429", "429"}, string(structToJson(quoteMsg)), structToJson(deadLettered(retriedMsg, 429, ""))).SetVal(int64(1))
+	mock.ExpectLRange("502", 0, 99).SetVal([]string{})
+
+	results, err := cli.DrainDeadQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, []ExecResult{
+		{Name: "Fetch order book", StatusCode: 200, Success: true},
+		{Name: "Fetch quote", StatusCode: 429, Success: false},
+	}, results)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFollowRedirects(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/old", ReqMethod: "GET"}
+
+	// Redirects are followed by default
+	cli.httpClient = newHTTPClient(ClientParam{})
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Original 3xx status is returned
+	follow := false
+	cli.httpClient = newHTTPClient(ClientParam{FollowRedirects: &follow})
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":301`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	err = cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// User HTTPClient is copied, not changed
+	userClient := &http.Client{Timeout: time.Second}
+	httpClient := newHTTPClient(ClientParam{HTTPClient: userClient, FollowRedirects: &follow})
+	assert.NotNil(t, httpClient.CheckRedirect)
+	assert.Nil(t, userClient.CheckRedirect)
+	assert.Same(t, userClient, newHTTPClient(ClientParam{HTTPClient: userClient}))
+}
+
+func TestExecuteBlocking(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET"}
+	expectNoPromoted()
+	mock.ExpectBLPop(time.Second, "ReqQueue").SetVal([]string{"ReqQueue", string(structToJson(reqMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+
+	err := cli.ExecuteBlocking(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message not executed is pushed back to the head
+	cli.dryRun = true
+	expectNoPromoted()
+	mock.ExpectBLPop(time.Second, "ReqQueue").SetVal([]string{"ReqQueue", string(structToJson(reqMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch order book", DryRunBody, 0).SetVal("OK")
+	mock.ExpectLPush("ReqQueue", string(structToJson(reqMsg))).SetVal(1)
+
+	err = cli.ExecuteBlocking(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	cli.dryRun = false
+
+	// Queue lock is held while the message is executed
+	cli.lockTTL = time.Minute
+	expectNoPromoted()
+	mock.Regexp().ExpectSetNX("ReqQueue:lock", `.+`, time.Minute).SetVal(false)
+
+	err = cli.ExecuteBlocking(time.Second)
+	assert.True(t, errors.Is(err, ErrQueueLocked))
+	assert.Nil(t, mock.ExpectationsWereMet())
+	cli.lockTTL = 0
+
+	// No message within the timeout
+	expectNoPromoted()
+	mock.ExpectBLPop(time.Second, "ReqQueue").RedisNil()
+
+	err = cli.ExecuteBlocking(time.Second)
+	assert.True(t, errors.Is(err, ErrQueueEmpty))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message is pushed back on the client context cancellation during it's
+	// execution
+	MockRedis()
+	hook := ctxHook{errs: map[string]error{}}
+	db.AddHook(hook)
+	ctx, cancel := context.WithCancel(context.Background())
+	cli.ctx = ctx
+	cli.mutator = func(msg InputMsg) InputMsg {
+		cancel()
+		return msg
+	}
+	expectNoPromoted()
+	mock.ExpectBLPop(time.Second, "ReqQueue").SetVal([]string{"ReqQueue", string(structToJson(reqMsg))})
+	mock.ExpectLPush("ReqQueue", string(structToJson(reqMsg))).SetVal(1)
+
+	err = cli.ExecuteBlocking(time.Second)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Contains(t, hook.errs, "lpush")
+	assert.Nil(t, hook.errs["lpush"])
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTracing(t *testing.T) {
+	MockRedis()
+	tracer := &testTracer{}
+	cli.tracer = tracer.Tracer(TracerName)
+	cli.propagator = propagation.TraceContext{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Trace context is propagated to the upstream
+		assert.NotEmpty(t, r.Header.Get("Traceparent"))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Fetch quote", Url: server.URL, ReqMethod: "GET"}
+	mock.Regexp().ExpectSet("resp:Fetch quote", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadLettered(reqMsg, 429, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Len(t, tracer.spans, 1)
+	span := tracer.spans[0]
+	assert.Equal(t, "dlq.execute ReqQueue", span.name)
+	assert.True(t, span.ended)
+	assert.Equal(t, codes.Error, span.status)
+	assert.Contains(t, span.attrs, attribute.String("http.method", "GET"))
+	assert.Contains(t, span.attrs, attribute.String("dlq.queue", "ReqQueue"))
+	assert.Contains(t, span.attrs, attribute.Int("http.status_code", 429))
+}
+
+func TestCookieJar(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123", Path: "/"})
+			return
+		}
+		// Order book needs the session cookie set by the login
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "abc123" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	jar, _ := cookiejar.New(nil)
+	cli.httpClient = &http.Client{Jar: jar, Timeout: 2 * time.Second}
+
+	loginMsg := InputMsg{Name: "Login", Url: server.URL + "/login", ReqMethod: "POST"}
+	orderMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET", Headers: http.Header{"X-Kite-Version": []string{"3"}}}
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{string(structToJson(loginMsg)), string(structToJson(orderMsg))})
+	mock.Regexp().ExpectSet("resp:Login", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(loginMsg))).SetVal(1)
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	// Message is removed as is, without the cookie added to the request
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(orderMsg))).SetVal(1)
+
+	processed, err := cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQueueConcurrency(t *testing.T) {
+	MockRedis()
+	cli.concurrency = 2
+	mock.MatchExpectationsInOrder(false)
+	defer mock.MatchExpectationsInOrder(true)
+
+	// Test server responds only once both the requests are in-flight
+	inFlight := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight <- struct{}{}
+		for len(inFlight) < 2 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	cli.httpClient = &http.Client{Timeout: 2 * time.Second}
+
+	orderMsg := InputMsg{Name: "Fetch order book", Url: server.URL + "/orders", ReqMethod: "GET"}
+	tradeMsg := InputMsg{Name: "Fetch trades", Url: server.URL + "/trades", ReqMethod: "GET"}
+	expectNoPromoted()
+	mock.ExpectLRange("ReqQueue", 0, 99).SetVal([]string{string(structToJson(orderMsg)), string(structToJson(tradeMsg))})
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, 0).SetVal("OK")
+	mock.Regexp().ExpectSet("resp:Fetch trades", `"StatusCode":200`, 0).SetVal("OK")
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(orderMsg))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, string(structToJson(tradeMsg))).SetVal(1)
+
+	processed, err := cli.ExecuteQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// deadLettered adds failed attempt of statusCode to the message retry trail
+// along with the originQueue, empty for message executed from the dead queue
+func deadLettered(msg InputMsg, statusCode int, originQueue string) InputMsg {
+	msg.Attempts = append(msg.Attempts, Attempt{StatusCode: statusCode})
+	if originQueue != "" {
+		msg.OriginQueue = originQueue
+	}
+	return msg
+}
+
+// matchIgnoreGenerated compares redis commands ignoring the generated message
+// ID, FailedAt and attempt time and error
+func matchIgnoreGenerated(expected, actual []interface{}) error {
+	strip := func(args []interface{}) []interface{} {
+		var out []interface{}
+		for _, arg := range args {
+			if b, ok := arg.([]byte); ok {
+				var msg InputMsg
+				if json.Unmarshal(b, &msg) == nil {
+					msg.ID = ""
+					msg.EnqueuedAt = time.Time{}
+					msg.FailedAt = time.Time{}
+					for i := range msg.Attempts {
+						msg.Attempts[i].Timestamp = time.Time{}
+						msg.Attempts[i].Error = ""
+					}
+					arg = string(structToJson(msg))
+				}
+			}
+			out = append(out, arg)
+		}
+		return out
+	}
+	if !reflect.DeepEqual(strip(expected), strip(actual)) {
+		return fmt.Errorf("expected %v, got %v", expected, actual)
+	}
+	return nil
+}
+
+func TestMessageResponseTTL(t *testing.T) {
+	MockRedis()
+	cli.responseTTL = time.Hour
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":200`, time.Hour).SetVal("OK")
+
+	cli.MessageResponse("Fetch order book", ResponseRecord{StatusCode: 200})
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestKeepFailedResponses(t *testing.T) {
+	MockRedis()
+	cli.keepFailed = 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"status":"error","message":"Too many requests"}`))
+	}))
+	defer server.Close()
+
+	// Third attempt of the dead message, first attempt response is deleted
+	reqMsg := InputMsg{Name: "Fetch quote", Url: server.URL, ReqMethod: "GET", Retries: 1, OriginQueue: "ReqQueue"}
+	reqMsg = deadLettered(deadLettered(reqMsg, 429, ""), 429, "")
+	retriedMsg := deadLettered(reqMsg, 429, "")
+	retriedMsg.Retries++
+	mock.Regexp().ExpectSet("resp:Fetch quote", `Too many requests`, 0).SetVal("OK")
+	mock.Regexp().ExpectSet("resp:Fetch quote:3", `Too many requests`, 0).SetVal("OK")
+	mock.ExpectDel("resp:Fetch quote:1").SetVal(1)
+	mock.CustomMatch(matchIgnoreGenerated).ExpectEval(moveScript, []string{"429", "429"}, string(structToJson(reqMsg)), structToJson(retriedMsg)).SetVal(int64(1))
+
+	err := cli.RawExecute(reqMsg, "429")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	record, _ := json.Marshal(ResponseRecord{StatusCode: 429, Body: `{"status":"error","message":"Too many requests"}`})
+	mock.ExpectGet("resp:Fetch quote:3").SetVal(string(record))
+	detail, err := cli.FailedResponseDetail("Fetch quote", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 429, detail.StatusCode)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMessageResponseDetail(t *testing.T) {
+	MockRedis()
+	executedAt := time.Date(2022, 6, 27, 9, 15, 0, 0, time.UTC)
+	record := ResponseRecord{
+		StatusCode: 200,
+		Headers:    http.Header{"Content-Type": []string{"application/json"}},
+		Body:       `{"status":"success","data":{"order_id":"220627001805439"}}`,
+		ExecutedAt: executedAt,
+	}
+	recordJSON, _ := json.Marshal(record)
+	mock.ExpectGet("resp:Place TCS Order").SetVal(string(recordJSON))
+
+	detail, err := cli.MessageResponseDetail("Place TCS Order")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, detail.StatusCode)
+	assert.Equal(t, record.Body, detail.Body)
+	assert.True(t, executedAt.Equal(detail.ExecutedAt))
+}
+
+func TestDelayedMessage(t *testing.T) {
+	MockRedis()
+	executeAt := time.Now().Add(-time.Minute)
+	reqMsg := InputMsg{
+		ID:        NewMsgID(),
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+		ExecuteAt: executeAt,
+		// Set so the stored member is deterministic
+		EnqueuedAt: time.Date(2022, 1, 3, 9, 15, 0, 0, time.UTC),
+	}
+	mock.ExpectZAdd("ReqQueue:delayed", &redis.Z{
+		Score:  float64(executeAt.UnixNano() / int64(time.Millisecond)),
+		Member: structToJson(reqMsg),
+	}).SetVal(1)
+	err := cli.AddDelayedMessage(reqMsg)
+	assert.Nil(t, err)
+
+	// Due message is moved to the request queue before execution
+	mock.Regexp().ExpectZRangeByScore("ReqQueue:delayed", &redis.ZRangeBy{Min: "-inf", Max: `^\d+$`}).
+		SetVal([]string{string(structToJson(reqMsg))})
+	mock.ExpectZRem("ReqQueue:delayed", string(structToJson(reqMsg))).SetVal(1)
+	mock.ExpectRPush("ReqQueue", string(structToJson(reqMsg))).SetVal(1)
+	mock.ExpectZRange("ReqQueue:priority", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("ReqQueue", 0, 99).SetErr(errors.New("stop after promote"))
+
+	_, err = cli.ExecuteQueue()
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMultipleQueues(t *testing.T) {
+	MockRedis()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	reqMsg := InputMsg{Name: "Send order alert", Url: server.URL, ReqMethod: "POST"}
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("orders", structToJson(reqMsg)).SetVal(1)
+	err := cli.AddMessageTo("orders", reqMsg)
+	assert.Nil(t, err)
+
+	// Dead message is moved to the dead queue of it's own request queue
+	assert.Equal(t, "429", cli.DeadQueueName("ReqQueue", 429))
+	assert.Equal(t, "orders:429", cli.DeadQueueName("orders", 429))
+	deadMsg := deadLettered(reqMsg, 429, "orders")
+	assert.True(t, cli.isDeadMsg("orders:429", deadMsg))
+	assert.False(t, cli.isDeadMsg("orders", deadMsg))
+	mock.ExpectZRange("orders:priority", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("orders", 0, 99).SetVal([]string{string(structToJson(reqMsg))})
+	mock.Regexp().ExpectSet("resp:Send order alert", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("orders:429", structToJson(deadMsg)).SetVal(1)
+	mock.ExpectLRem("orders", 1, string(structToJson(reqMsg))).SetVal(1)
+
+	processed, err := cli.ExecuteQueueOf("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Retry stays in the dead queue of the request queue
+	retriedMsg := deadLettered(deadMsg, 429, "")
+	retriedMsg.Retries++
+	mock.ExpectLRange("orders:400", 0, 99).SetVal([]string{})
+	mock.ExpectLRange("orders:429", 0, 99).SetVal([]string{string(structToJson(deadMsg))})
+	mock.Regexp().ExpectSet("resp:Send order alert", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectEval(moveScript, []string{"orders:429", "orders:429"}, string(structToJson(deadMsg)), structToJson(retriedMsg)).SetVal(int64(1))
+	mock.ExpectLRange("orders:502", 0, 99).SetVal([]string{})
+
+	processed, err = cli.ExecuteDeadQueueOf("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, processed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeadQueuesOf(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{StatusNetworkError, StatusCustomDead, 429}
+	reqMsg := InputMsg{Name: "Send order alert", Url: "https://api.kite.trade/orders", ReqMethod: "POST"}
+	// Request queues named like dead queues aren't taken as dead queues
+	assert.False(t, cli.isDeadMsg("tenant:1", reqMsg))
+	assert.False(t, cli.isDeadMsg("shard:0", reqMsg))
+	assert.False(t, cli.isDeadMsg("orders:429", reqMsg))
+	// Dead queue is decided from the message origin queue and last failure
+	deadMsg := deadLettered(reqMsg, 429, "orders")
+	assert.True(t, cli.isDeadMsg("orders:429", deadMsg))
+	assert.False(t, cli.isDeadMsg("orders:0", deadMsg))
+	assert.False(t, cli.isDeadMsg("orders", deadMsg))
+	assert.True(t, cli.isDeadMsg("orders:1", deadLettered(reqMsg, 200, "orders")))
+	// Message stored without the origin queue is dead in the request queue
+	// dead queues
+	assert.True(t, cli.isDeadMsg("1", reqMsg))
+	assert.False(t, cli.isDeadMsg("ReqQueue", reqMsg))
+
+	mock.ExpectLLen("orders:0").SetVal(0)
+	mock.ExpectLLen("orders:1").SetVal(0)
+	mock.ExpectLLen("orders:429").SetVal(1)
+	length, err := cli.DeadQueueLengthOf("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), length)
+
+	mock.ExpectLRange("orders:429", 0, -1).SetVal([]string{string(structToJson(deadMsg))})
+	msgs, err := cli.GetDeadMessagesByCodeOf("orders", 429)
+	assert.Nil(t, err)
+	assert.Equal(t, []InputMsg{deadMsg}, msgs)
+
+	// Dead message is requeued to the request queue it originated from
+	requeuedMsg := deadMsg
+	requeuedMsg.Retries = 0
+	requeuedMsg.FailedAt = time.Time{}
+	mock.ExpectLRange("orders:0", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("orders:1", 0, -1).SetVal([]string{})
+	mock.ExpectLRange("orders:429", 0, -1).SetVal([]string{string(structToJson(deadMsg))})
+	mock.ExpectEval(moveScript, []string{"orders:429", "orders"}, string(structToJson(deadMsg)), structToJson(requeuedMsg)).SetVal(int64(1))
+	err = cli.RequeueDeadMessageOf("orders", "Send order alert")
+	assert.Nil(t, err)
+
+	mock.ExpectLLen("orders").SetVal(1)
+	mock.ExpectLLen("orders:0").SetVal(0)
+	mock.ExpectLLen("orders:1").SetVal(0)
+	mock.ExpectLLen("orders:429").SetVal(0)
+	mock.ExpectLLen("failed").SetVal(0)
+	stats, err := cli.StatsOf("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, QueueStats{ReqQueue: 1, DeadQueues: map[int]int64{StatusNetworkError: 0, StatusCustomDead: 0, 429: 0}}, stats)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPriorityMessage(t *testing.T) {
+	MockRedis()
+	plainMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	highMsg := InputMsg{Name: "Cancel order", Url: "https://api.kite.trade/orders/regular/1", ReqMethod: "DELETE", Priority: 5}
+	lowMsg := InputMsg{Name: "Fetch holdings", Url: "https://api.kite.trade/portfolio/holdings", ReqMethod: "GET", Priority: -1}
+	// Plain messages are pushed to the queue, priority ones added to the sorted set
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(plainMsg)).SetVal(1)
+	mock.CustomMatch(func(expected, actual []interface{}) error {
+		// Scores are the time the messages are added
+		args := append([]interface{}{}, actual...)
+		for i := 2; i < len(args); i += 2 {
+			args[i] = expected[i]
+		}
+		return matchIgnoreGenerated(expected, args)
+	}).ExpectZAdd("ReqQueue:priority", &redis.Z{Member: structToJson(highMsg)}, &redis.Z{Member: structToJson(lowMsg)}).SetVal(2)
+
+	err := cli.AddMessages([]InputMsg{plainMsg, highMsg, lowMsg})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Highest priority ends up at the queue head, same priority in the order
+	// added, negative priority at the tail
+	highMsg.ID = NewMsgID()
+	lowMsg.ID = NewMsgID()
+	secondHighMsg := highMsg
+	secondHighMsg.ID = NewMsgID()
+	topMsg := InputMsg{ID: NewMsgID(), Name: "Exit position", Url: "https://api.kite.trade/orders/regular", ReqMethod: "POST", Priority: 10}
+	members := []string{string(structToJson(highMsg)), string(structToJson(lowMsg)), string(structToJson(secondHighMsg)), string(structToJson(topMsg))}
+	mock.Regexp().ExpectZRangeByScore("ReqQueue:delayed", &redis.ZRangeBy{Min: "-inf", Max: `^\d+$`}).SetVal([]string{})
+	mock.ExpectZRange("ReqQueue:priority", 0, -1).SetVal(members)
+	for _, idx := range []int{2, 0, 3} {
+		mock.ExpectZRem("ReqQueue:priority", members[idx]).SetVal(1)
+		mock.ExpectLPush("ReqQueue", members[idx]).SetVal(1)
+	}
+	mock.ExpectZRem("ReqQueue:priority", members[1]).SetVal(1)
+	mock.ExpectRPush("ReqQueue", members[1]).SetVal(1)
+	mock.ExpectLRange("ReqQueue", 0, 99).SetErr(errors.New("stop after promote"))
+
+	_, err = cli.ExecuteQueue()
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMetrics(t *testing.T) {
+	MockRedis()
+	metrics := &testMetrics{depth: map[string]int64{}}
+	cli.metrics = metrics
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	reqMsg := InputMsg{Name: "Fetch order book", Url: server.URL, ReqMethod: "GET"}
+
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("ReqQueue", structToJson(reqMsg)).SetVal(1)
+	mock.ExpectLLen("ReqQueue").SetVal(1)
+	err := cli.AddMessage(reqMsg)
+	assert.Nil(t, err)
+
+	mock.Regexp().ExpectSet("resp:Fetch order book", `"StatusCode":429`, 0).SetVal("OK")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadLettered(reqMsg, 429, "ReqQueue"))).SetVal(1)
+	mock.ExpectLLen("429").SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	mock.ExpectLLen("ReqQueue").SetVal(0)
+	err = cli.RawExecute(reqMsg, "ReqQueue")
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, metrics.enqueued)
+	assert.Equal(t, 1, metrics.executed)
+	assert.Equal(t, 0, metrics.succeeded)
+	assert.Equal(t, 1, metrics.deadLettered)
+	assert.Equal(t, map[string]int64{"ReqQueue": 0, "429": 1}, metrics.depth)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// expectNoPromoted mocks empty delayed and priority messages sets of the
+// request queue
+func expectNoPromoted() {
+	mock.Regexp().ExpectZRangeByScore("ReqQueue:delayed", &redis.ZRangeBy{Min: "-inf", Max: `^\d+$`}).SetVal([]string{})
+	mock.ExpectZRange("ReqQueue:priority", 0, -1).SetVal([]string{})
+}
+
+// testTracer records the spans started by the client
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (tr *testTracer) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return tr
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	config := trace.NewSpanStartConfig(opts...)
+	span := &testSpan{
+		Span:  trace.SpanFromContext(context.Background()),
+		name:  name,
+		attrs: config.Attributes(),
+	}
+	tr.spans = append(tr.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+// testSpan records the span attributes and status
+type testSpan struct {
+	trace.Span
+	name   string
+	attrs  []attribute.KeyValue
+	status codes.Code
+	ended  bool
+}
+
+func (s *testSpan) SpanContext() trace.SpanContext {
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	})
+}
+
+func (s *testSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.attrs = append(s.attrs, kv...)
+}
+
+func (s *testSpan) SetStatus(code codes.Code, description string) {
+	s.status = code
+}
+
+func (s *testSpan) End(options ...trace.SpanEndOption) {
+	s.ended = true
+}
+
+// testLogger records all the client logs
+type testLogger struct {
+	logs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Errorf(format string, v ...interface{}) {
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+// testMetrics counts all the instrumented queue operations
+type testMetrics struct {
+	enqueued     int
+	executed     int
+	succeeded    int
+	deadLettered int
+	dropped      int
+	depth        map[string]int64
+}
+
+func (m *testMetrics) MsgEnqueued(qName string) {
+	m.enqueued++
+}
+
+func (m *testMetrics) MsgExecuted(qName string, statusCode int, success bool, latency time.Duration) {
+	m.executed++
+	if success {
+		m.succeeded++
+	}
+}
+
+func (m *testMetrics) MsgDeadLettered(deadQName string, statusCode int) {
+	m.deadLettered++
+}
+
+func (m *testMetrics) QueueDepth(qName string, depth int64) {
+	m.depth[qName] = depth
+}
+
+func (m *testMetrics) MsgDropped(deadQName string, count int) {
+	m.dropped += count
+}
+
+// structToString parses struct to json for redis mock
+func structToJson(msg InputMsg) []byte {
+	jsonMessage, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("%v", err)
+	}
+	return jsonMessage
+}
+
+func TestRawExecuteError(t *testing.T) {
+	// Closed test server to simulate an unreachable upstream
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	reqMsg := InputMsg{
+		Name:      "Unreachable upstream",
+		Url:       server.URL,
+		ReqMethod: "GET",
+	}
+	err := cli.RawExecute(reqMsg, "ReqQueue")
+	assert.NotNil(t, err)
+}
+
+func TestDeadHTTPCodes(t *testing.T) {
+	// Nil sets the default status codes along with the custom dead queue
+	assert.Equal(t, []int{StatusNetworkError, 400, 403, 429, 500, 502, 503, 504, StatusCustomDead}, deadHTTPCodes(nil))
+	assert.Equal(t, []int{429, StatusCustomDead}, deadHTTPCodes([]int{429}))
+	// Caller's slice with spare capacity isn't written
+	userCodes := make([]int, 1, 4)
+	userCodes[0] = 429
+	assert.Equal(t, []int{429, StatusCustomDead}, deadHTTPCodes(userCodes))
+	assert.Equal(t, []int{429, 0}, userCodes[:2])
+	// Empty disables the dead lettering
+	assert.Equal(t, []int{}, deadHTTPCodes([]int{}))
+}
+
+func TestHandleDeadQueueDisabled(t *testing.T) {
+	MockRedis()
+	cli.deadHTTP = []int{}
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	// Dead message is only removed from the queue
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+
+	cli.handleDead(reqMsg, storedMsg{}, "ReqQueue", true, 429, "429 Too Many Requests")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleDeadQueueMaxRetries(t *testing.T) {
+	MockRedis()
+	cli.maxRetries = 2
+
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+		Retries:   1,
+	}
+	res := &http.Response{StatusCode: 429, Status: "429 Too Many Requests"}
+
+	// Message retried from dead queue reaches max retries and moves to failed queue
+	failedMsg := reqMsg
+	failedMsg.Retries = 2
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush(QueueFailed, structToJson(deadLettered(failedMsg, 429, ""))).SetVal(1)
+	mock.ExpectLRem("429", 1, structToJson(reqMsg)).SetVal(1)
+
+	var failedName string
+	var failedAttempts []Attempt
+	cli.onFailure = func(msg InputMsg, attempts []Attempt) {
+		failedName = msg.Name
+		failedAttempts = attempts
+	}
+	cli.HandleDeadQueue(res, reqMsg, "429")
+	assert.Nil(t, mock.ExpectationsWereMet())
+	// Permanent failure is notified with the retry trail
+	assert.Equal(t, "Fetch order book", failedName)
+	assert.Len(t, failedAttempts, 1)
+	assert.Equal(t, 429, failedAttempts[0].StatusCode)
+}
+
+func TestMaxDeadQueueSize(t *testing.T) {
+	MockRedis()
+	metrics := &testMetrics{depth: map[string]int64{}}
+	cli.metrics = metrics
+	cli.maxDeadSize = 3
+
+	reqMsg := InputMsg{Name: "Fetch order book", Url: "https://api.kite.trade/orders", ReqMethod: "GET"}
+	// Oldest dead message is trimmed to fit the new one
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadLettered(reqMsg, 429, "ReqQueue"))).SetVal(4)
+	mock.ExpectLTrim("429", -3, -1).SetVal("OK")
+	mock.ExpectLLen("429").SetVal(3)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	mock.ExpectLLen("ReqQueue").SetVal(0)
+
+	assert.True(t, cli.handleDead(reqMsg, storedMsg{}, "ReqQueue", true, 429, "429 Too Many Requests"))
+	assert.Equal(t, 1, metrics.deadLettered)
+	assert.Equal(t, 1, metrics.dropped)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// New dead message is dropped from the full dead queue
+	cli.overflow = OverflowReject
+	mock.ExpectLLen("429").SetVal(3)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(reqMsg)).SetVal(1)
+	mock.ExpectLLen("ReqQueue").SetVal(0)
+
+	assert.True(t, cli.handleDead(reqMsg, storedMsg{}, "ReqQueue", true, 429, "429 Too Many Requests"))
+	assert.Equal(t, 1, metrics.deadLettered)
+	assert.Equal(t, 2, metrics.dropped)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message retried from the full dead queue and failed again is replaced
+	// in place with either policy, it's neither dropped nor trimmed
+	deadMsg := deadLettered(reqMsg, 429, "ReqQueue")
+	retriedMsg := deadLettered(deadMsg, 429, "")
+	retriedMsg.Retries = 1
+	for _, overflow := range []OverflowPolicy{OverflowReject, OverflowDropOldest} {
+		cli.overflow = overflow
+		mock.CustomMatch(matchIgnoreGenerated).ExpectEval(moveScript, []string{"429", "429"}, string(structToJson(deadMsg)), structToJson(retriedMsg)).SetVal(int64(1))
+		mock.ExpectLLen("429").SetVal(3)
+
+		assert.True(t, cli.handleDead(deadMsg, storedMsg{raw: string(structToJson(deadMsg))}, "429", true, 429, "429 Too Many Requests"))
+		assert.Equal(t, 2, metrics.dropped)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	}
+	assert.Equal(t, 3, metrics.deadLettered)
+}
+
+func TestRetryableHTTP(t *testing.T) {
+	MockRedis()
+	cli.retryable = []int{429, 502}
+	var failedName string
+	cli.onFailure = func(msg InputMsg, attempts []Attempt) {
+		failedName = msg.Name
+	}
+
+	// Client error is failed permanently without retry
+	orderMsg := InputMsg{Name: "Place TCS Order", Url: "https://api.kite.trade/orders/regular", ReqMethod: "POST"}
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush(QueueFailed, structToJson(deadLettered(orderMsg, 400, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(orderMsg)).SetVal(1)
+	cli.handleDead(orderMsg, storedMsg{}, "ReqQueue", true, 400, "400 Bad Request")
+	assert.Equal(t, "Place TCS Order", failedName)
+
+	// Retryable status stays in it's dead queue
+	quoteMsg := InputMsg{Name: "Fetch quote", Url: "https://api.kite.trade/quote", ReqMethod: "GET"}
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush("429", structToJson(deadLettered(quoteMsg, 429, "ReqQueue"))).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(quoteMsg)).SetVal(1)
+	cli.handleDead(quoteMsg, storedMsg{}, "ReqQueue", true, 429, "429 Too Many Requests")
+	assert.Equal(t, "Place TCS Order", failedName)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeadToMainQueue(t *testing.T) {
+	MockRedis()
+	cli.deadToMain = true
+	cli.maxRetries = 2
+
+	reqMsg := InputMsg{
+		Name:      "Fetch order book",
+		Url:       "https://api.kite.trade/orders",
+		ReqMethod: "GET",
+	}
+	res := &http.Response{StatusCode: 429, Status: "429 Too Many Requests"}
+
+	// Failed message is pushed back to the request queue, first failure
+	// isn't counted as a retry same as with the dead queues
+	deadMsg := deadLettered(reqMsg, 429, "ReqQueue")
+	mock.CustomMatch(matchIgnoreGenerated).ExpectEval(moveScript, []string{"ReqQueue", "ReqQueue"}, string(structToJson(reqMsg)), structToJson(deadMsg)).SetVal(int64(1))
+
+	cli.HandleDeadQueue(res, reqMsg, "ReqQueue")
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Failure of the pushed back message counts a retry
+	retriedMsg := deadLettered(deadMsg, 429, "")
+	retriedMsg.Retries = 1
+	mock.CustomMatch(matchIgnoreGenerated).ExpectEval(moveScript, []string{"ReqQueue", "ReqQueue"}, string(structToJson(deadMsg)), structToJson(retriedMsg)).SetVal(int64(1))
+
+	cli.HandleDeadQueue(res, deadMsg, "ReqQueue")
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Message still moves to the failed queue on max retries
+	failedMsg := deadLettered(retriedMsg, 429, "")
+	failedMsg.Retries = 2
+	mock.CustomMatch(matchIgnoreGenerated).ExpectRPush(QueueFailed, structToJson(failedMsg)).SetVal(1)
+	mock.ExpectLRem("ReqQueue", 1, structToJson(retriedMsg)).SetVal(1)
+
+	cli.HandleDeadQueue(res, retriedMsg, "ReqQueue")
+	assert.Nil(t, mock.ExpectationsWereMet())
 }